@@ -0,0 +1,532 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/schedule"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/status"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/trigger"
+)
+
+// daemonJob is the schedule and work of a daemon built from one version
+// of the config file
+type daemonJob struct {
+	daemon   config.DaemonConfig
+	schedule *schedule.Schedule
+	run      func(ctx context.Context) error
+
+	// watch, if set, runs when files in watchDir have settled for
+	// watchDebounce
+	watch         func(ctx context.Context) error
+	watchDir      string
+	watchDebounce time.Duration
+
+	// trigger, if set, is served at /trigger to run the job immediately
+	trigger    *trigger.Handler
+	triggerCfg config.TriggerConfig
+}
+
+// runDaemon runs the job returned by load on its schedule until SIGINT or
+// SIGTERM. SIGHUP calls load again and switches to the new job unless it
+// fails, SIGUSR1 and requests to the trigger endpoint run the job
+// immediately.
+func runDaemon(name string, job *daemonJob, load func() (*daemonJob, error)) {
+	daemonCfg := job.daemon
+	logger := slog.With("mode", name)
+	logger.Info("starting daemon", job.scheduleAttrs()...)
+
+	// Trigger requests arriving during a run result in a single run after it
+	triggerChan := make(chan struct{}, 1)
+	var triggerHandler http.Handler
+	if job.trigger != nil {
+		job.trigger.Trigger = func() {
+			select {
+			case triggerChan <- struct{}{}:
+			default:
+			}
+		}
+		triggerHandler = job.trigger
+	}
+
+	d := &daemonLoop{
+		name:    name,
+		load:    load,
+		trigger: triggerChan,
+	}
+
+	// Serve metrics and status if a listen address is configured
+	if daemonCfg.Listen != "" {
+		server := startHTTPServer(daemonCfg.Listen, job.readyMaxAge(), triggerHandler)
+		defer server.Close()
+		d.status = runStatus
+	}
+
+	// Stop scheduling runs on signal and cancel the running one once the
+	// grace period expires
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	d.shutdown, d.runCtx = handleShutdown(logger, time.Duration(daemonCfg.ShutdownGraceSecs)*time.Second, sigChan)
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+	d.hup = hupChan
+
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	defer signal.Stop(usr1Chan)
+	d.usr1 = usr1Chan
+
+	d.run(job)
+}
+
+// daemonLoop schedules the runs of a daemon. Everything but the job is
+// fixed at startup.
+type daemonLoop struct {
+	name string
+	load func() (*daemonJob, error)
+
+	// shutdown stops scheduling runs, runCtx aborts the run in progress
+	shutdown context.Context
+	runCtx   context.Context
+
+	hup     <-chan os.Signal
+	usr1    <-chan os.Signal
+	trigger <-chan struct{}
+
+	// status, if set, serves readiness based on the schedule of the job
+	status *status.Tracker
+}
+
+// run runs job and the jobs it is reloaded to until shutdown
+func (d *daemonLoop) run(job *daemonJob) {
+	started := job
+	logger := slog.With("mode", d.name)
+
+	// Run watch as soon as files change if the job has one
+	watchChan, stopWatch := job.startWatch(d.shutdown, logger)
+	defer func() { stopWatch() }()
+
+	// Consecutive failed runs, retried with backoff instead of waiting for
+	// the next regular run
+	failures := 0
+	runJob := func() {
+		// run logs its own errors
+		if err := job.run(d.runCtx); err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+	}
+
+	// Run immediately on startup unless outside the window
+	if job.inWindow(time.Now()) {
+		runJob()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	next, retrying := job.reschedule(timer, logger, failures)
+
+	// Runs requested outside the window wait for its start, so reload
+	// commands only run within it. windowC is nil while none is deferred.
+	var (
+		windowTimer   *time.Timer
+		windowC       <-chan time.Time
+		runDeferred   bool
+		watchDeferred bool
+	)
+	deferToWindow := func() {
+		if windowTimer != nil {
+			windowTimer.Stop()
+		}
+		start := job.nextWindow(time.Now())
+		logger.Info("outside window, deferring run", "at", start)
+		windowTimer = time.NewTimer(time.Until(start))
+		windowC = windowTimer.C
+	}
+	defer func() {
+		if windowTimer != nil {
+			windowTimer.Stop()
+		}
+	}()
+
+	// runNow runs the job outside the schedule, returning false on shutdown
+	runNow := func() bool {
+		if !job.inWindow(time.Now()) {
+			runDeferred = true
+			deferToWindow()
+			return true
+		}
+		runDeferred = false
+
+		runJob()
+		if d.shutdown.Err() != nil {
+			return false
+		}
+
+		// Start or cancel retries, the regular schedule is kept otherwise
+		if retrying || failures > 0 {
+			next, retrying = job.reschedule(timer, logger, failures)
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			// A timer created before a clock jump may fire early
+			if time.Now().Before(next) {
+				timer.Reset(time.Until(next))
+				continue
+			}
+
+			// The regular run covers deferred runs and uploads
+			runDeferred, watchDeferred = false, false
+			runJob()
+			if d.shutdown.Err() != nil {
+				return
+			}
+			next, retrying = job.reschedule(timer, logger, failures)
+
+			// Changes made by the run itself have already been handled
+			select {
+			case <-watchChan:
+			default:
+			}
+
+		case <-watchChan:
+			if !job.inWindow(time.Now()) {
+				watchDeferred = true
+				deferToWindow()
+				continue
+			}
+			logger.Info("files changed, uploading")
+			job.watch(d.runCtx)
+
+		case <-windowC:
+			windowC = nil
+			switch {
+			case runDeferred:
+				logger.Info("window started, running deferred run")
+				watchDeferred = false
+				if !runNow() {
+					return
+				}
+			case watchDeferred && job.inWindow(time.Now()):
+				logger.Info("window started, uploading deferred changes")
+				watchDeferred = false
+				job.watch(d.runCtx)
+			case watchDeferred:
+				deferToWindow()
+			}
+
+		case <-d.usr1:
+			logger.Info("received SIGUSR1, running now")
+			if !runNow() {
+				return
+			}
+
+		case <-d.trigger:
+			logger.Info("received trigger request, running now")
+			if !runNow() {
+				return
+			}
+
+		case <-d.hup:
+			newJob, err := d.load()
+			if err != nil {
+				logger.Error("failed to reload config, keeping current config", "error", err)
+				continue
+			}
+
+			// The HTTP server, signal handling and trigger handler are set
+			// up once at startup
+			if newJob.daemon.Listen != started.daemon.Listen || newJob.daemon.ShutdownGraceSecs != started.daemon.ShutdownGraceSecs || newJob.triggerCfg != started.triggerCfg {
+				logger.Warn("listen, shutdown_grace_secs and trigger changes require a restart")
+			}
+
+			job = newJob
+			logger = slog.With("mode", d.name)
+			logger.Info("reloaded config", job.scheduleAttrs()...)
+			if d.status != nil {
+				d.status.SetReadyMaxAge(job.readyMaxAge())
+			}
+
+			stopWatch()
+			watchChan, stopWatch = job.startWatch(d.shutdown, logger)
+			next, retrying = job.reschedule(timer, logger, failures)
+
+			// The window may have changed
+			if job.watch == nil {
+				watchDeferred = false
+			}
+			if windowC != nil {
+				deferToWindow()
+			}
+
+		case <-d.shutdown.Done():
+			return
+		}
+
+		// Retries start over after the next regular run
+		if !retrying {
+			failures = 0
+		}
+	}
+}
+
+// reschedule resets timer to the next run of the job, or a retry after
+// failures consecutive failed runs. Returns its time and whether it is a
+// retry.
+func (j *daemonJob) reschedule(timer *time.Timer, logger *slog.Logger, failures int) (time.Time, bool) {
+	now := time.Now()
+	if retry, ok := j.schedule.Retry(now, failures); ok {
+		logger.Info("retrying failed run", "attempt", failures, "max_attempts", j.schedule.RetryAttempts, "at", retry)
+		timer.Reset(retry.Sub(now))
+		return retry, true
+	}
+
+	next := j.schedule.Next(now)
+	if next.IsZero() {
+		// The cron expression never matches, e.g. February 30th
+		logger.Warn("schedule has no next run")
+		timer.Stop()
+		return next, false
+	}
+
+	logger.Debug("next run scheduled", "at", next)
+	timer.Reset(next.Sub(now))
+	return next, false
+}
+
+// startWatch watches the watch directory of the job until ctx is cancelled
+// or the returned function is called. The channel is nil, which blocks
+// forever, if the job doesn't watch or watching fails.
+func (j *daemonJob) startWatch(ctx context.Context, logger *slog.Logger) (<-chan struct{}, context.CancelFunc) {
+	ctx, stop := context.WithCancel(ctx)
+	if j.watch == nil {
+		return nil, stop
+	}
+
+	changed, err := watchCertDir(ctx, logger, j.watchDir, j.watchDebounce)
+	if err != nil {
+		logger.Error("failed to watch for changes, relying on schedule", "error", err)
+		return nil, stop
+	}
+
+	logger.Info("watching for changes", "dir", j.watchDir, "debounce", j.watchDebounce)
+	return changed, stop
+}
+
+// inWindow reports whether the job may run at t
+func (j *daemonJob) inWindow(t time.Time) bool {
+	return j.schedule.Window == nil || j.schedule.Window.Contains(t)
+}
+
+// nextWindow returns t if the job may run at t, otherwise the start of its
+// next window
+func (j *daemonJob) nextWindow(t time.Time) time.Time {
+	if j.schedule.Window == nil {
+		return t
+	}
+	return j.schedule.Window.Next(t)
+}
+
+// readyMaxAge returns how recent the last successful run must be for the
+// daemon to be ready
+func (j *daemonJob) readyMaxAge() time.Duration {
+	readyIntervals := j.daemon.ReadyIntervals
+	if readyIntervals <= 0 {
+		readyIntervals = 2
+	}
+	return time.Duration(readyIntervals) * j.schedule.Period(time.Now())
+}
+
+// scheduleAttrs describes the schedule of the job for logging
+func (j *daemonJob) scheduleAttrs() []any {
+	var attrs []any
+	if j.daemon.Cron != "" {
+		attrs = append(attrs, "cron", j.daemon.Cron)
+	} else {
+		attrs = append(attrs, "interval", j.schedule.Interval)
+	}
+	attrs = append(attrs, "jitter", j.schedule.Jitter)
+	if j.daemon.Window != "" {
+		attrs = append(attrs, "window", j.daemon.Window)
+	}
+	return attrs
+}
+
+// handleShutdown watches sigChan for SIGINT and SIGTERM. The returned
+// shutdown context is cancelled on the first signal. The run context is
+// cancelled after the grace period or on a second signal, aborting commands
+// and S3 requests of a run still in progress.
+func handleShutdown(logger *slog.Logger, grace time.Duration, sigChan <-chan os.Signal) (shutdown, run context.Context) {
+	shutdown, stopScheduling := context.WithCancel(context.Background())
+	run, cancelRun := context.WithCancel(context.Background())
+
+	go func() {
+		sig := <-sigChan
+		logger.Info("received signal, shutting down", "signal", sig.String(), "grace_period", grace)
+		stopScheduling()
+
+		select {
+		case <-time.After(grace):
+		case sig = <-sigChan:
+			logger.Info("received second signal, cancelling run", "signal", sig.String())
+		}
+		cancelRun()
+	}()
+
+	return shutdown, run
+}
+
+// runPushDaemon runs push as a daemon, reloading configPath on SIGHUP
+func runPushDaemon(configPath string, cfg *config.PushConfig) {
+	job, err := pushJob(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up daemon: %v", err)
+	}
+
+	runDaemon("push", job, func() (*daemonJob, error) {
+		cfg, err := config.LoadPush(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := setupLogging(cfg.Log); err != nil {
+			return nil, err
+		}
+		return pushJob(cfg)
+	})
+}
+
+func pushJob(cfg *config.PushConfig) (*daemonJob, error) {
+	sched, err := cfg.Daemon.Schedule()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &daemonJob{
+		daemon:   cfg.Daemon,
+		schedule: sched,
+		run: func(ctx context.Context) error {
+			return runPush(ctx, cfg)
+		},
+	}
+
+	// Upload certificates written by a manual lego run or another ACME
+	// client without waiting for the schedule
+	if cfg.Watch.Enabled {
+		job.watch = func(ctx context.Context) error {
+			return runPushChanges(ctx, cfg)
+		}
+		job.watchDir = cfg.CertDir
+		job.watchDebounce = time.Duration(cfg.Watch.DebounceSecs) * time.Second
+		if job.watchDebounce <= 0 {
+			job.watchDebounce = defaultWatchDebounce
+		}
+	}
+
+	return job, nil
+}
+
+// runPullDaemon runs pull as a daemon, reloading configPath on SIGHUP
+func runPullDaemon(configPath string, cfg *config.PullConfig) {
+	job, err := pullJob(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up daemon: %v", err)
+	}
+
+	runDaemon("pull", job, func() (*daemonJob, error) {
+		cfg, err := config.LoadPull(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := setupLogging(cfg.Log); err != nil {
+			return nil, err
+		}
+		return pullJob(cfg)
+	})
+}
+
+func pullJob(cfg *config.PullConfig) (*daemonJob, error) {
+	sched, err := cfg.Daemon.Schedule()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &daemonJob{
+		daemon:   cfg.Daemon,
+		schedule: sched,
+		run: func(ctx context.Context) error {
+			return runPull(ctx, cfg)
+		},
+		triggerCfg: cfg.Trigger,
+	}
+
+	// Let push or bucket notifications start a pull right away
+	if cfg.Trigger.Enabled() {
+		secret, err := cfg.Trigger.Secret.Load()
+		if err != nil {
+			return nil, fmt.Errorf("load trigger secret: %w", err)
+		}
+		token, err := cfg.Trigger.Token.Load()
+		if err != nil {
+			return nil, fmt.Errorf("load trigger token: %w", err)
+		}
+		job.trigger = &trigger.Handler{Secret: secret, Token: token}
+	}
+
+	return job, nil
+}
+
+// startHTTPServer serves the metrics and status endpoints and, if it isn't
+// nil, triggerHandler at /trigger on addr in the background
+func startHTTPServer(addr string, readyMaxAge time.Duration, triggerHandler http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", runMetrics.Handler())
+	runStatus.Register(mux, readyMaxAge)
+	if triggerHandler != nil {
+		mux.Handle("/trigger", triggerHandler)
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		slog.Info("serving metrics and status", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server failed", "addr", addr, "error", err)
+		}
+	}()
+
+	return server
+}
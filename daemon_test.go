@@ -0,0 +1,166 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/schedule"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/status"
+)
+
+func TestHandleShutdownSecondSignal(t *testing.T) {
+	sigChan := make(chan os.Signal, 2)
+	shutdown, run := handleShutdown(slog.New(slog.DiscardHandler), time.Hour, sigChan)
+
+	// The first signal stops scheduling, the run may finish
+	sigChan <- syscall.SIGTERM
+	<-shutdown.Done()
+	select {
+	case <-run.Done():
+		t.Fatal("Run was cancelled within the grace period")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The second one aborts it
+	sigChan <- syscall.SIGINT
+	select {
+	case <-run.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Second signal did not cancel the run")
+	}
+}
+
+func TestHandleShutdownGracePeriod(t *testing.T) {
+	sigChan := make(chan os.Signal, 2)
+	shutdown, run := handleShutdown(slog.New(slog.DiscardHandler), 100*time.Millisecond, sigChan)
+
+	start := time.Now()
+	sigChan <- syscall.SIGTERM
+	<-shutdown.Done()
+	select {
+	case <-run.Done():
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("Run was cancelled before the grace period, after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run was not cancelled after the grace period")
+	}
+}
+
+// testJob returns a job on an interval that records its runs in runs
+func testJob(interval time.Duration, name string, runs chan<- string) *daemonJob {
+	return &daemonJob{
+		daemon:   config.DaemonConfig{ReadyIntervals: 2},
+		schedule: &schedule.Schedule{Interval: interval},
+		run: func(ctx context.Context) error {
+			runs <- name
+			return nil
+		},
+	}
+}
+
+// expectRun waits for the next run and checks which job it was
+func expectRun(t *testing.T, runs <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-runs:
+		if got != want {
+			t.Errorf("Expected a run of %s, got %s", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a run of %s", want)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	runs := make(chan string, 10)
+	current := testJob(time.Hour, "old", runs)
+	next := testJob(3*time.Hour, "new", runs)
+
+	loadErr := errors.New("invalid config")
+	loads := make(chan *daemonJob, 1)
+	hup := make(chan os.Signal, 1)
+	usr1 := make(chan os.Signal, 1)
+	shutdown, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	tracker := &status.Tracker{}
+	mux := http.NewServeMux()
+	tracker.Register(mux, current.readyMaxAge())
+	readyz := func() string {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		return recorder.Body.String()
+	}
+
+	d := &daemonLoop{
+		name: "test",
+		load: func() (*daemonJob, error) {
+			if job := <-loads; job != nil {
+				return job, nil
+			}
+			return nil, loadErr
+		},
+		shutdown: shutdown,
+		runCtx:   context.Background(),
+		hup:      hup,
+		usr1:     usr1,
+		status:   tracker,
+	}
+	done := make(chan struct{})
+	go func() {
+		d.run(current)
+		close(done)
+	}()
+
+	// The job runs on startup
+	expectRun(t, runs, "old")
+	if body := readyz(); !strings.Contains(body, "2h0m0s") {
+		t.Errorf("Unexpected /readyz before reload: %q", body)
+	}
+
+	// A config that fails to load keeps the current job
+	loads <- nil
+	hup <- syscall.SIGHUP
+	usr1 <- syscall.SIGUSR1
+	expectRun(t, runs, "old")
+
+	// Otherwise the new job replaces it, including its readiness
+	loads <- next
+	hup <- syscall.SIGHUP
+	usr1 <- syscall.SIGUSR1
+	expectRun(t, runs, "new")
+	if body := readyz(); !strings.Contains(body, "6h0m0s") {
+		t.Errorf("Max age was not recomputed on reload: %q", body)
+	}
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop on shutdown")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/bundle"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Defaults written into the pull configuration of a new client,
+// matching the directories created by the packages
+const (
+	defaultKeyDir  = "/var/lib/digilol-cert-pushpuller/keys"
+	defaultCertDir = "/var/lib/digilol-cert-pushpuller/certificates"
+)
+
+// enrollPullConfig is the subset of the pull configuration written into
+// bundles, keeping the generated file as short as the example config
+type enrollPullConfig struct {
+	KeyDir    string                 `toml:"key_dir"`
+	CertDir   string                 `toml:"cert_dir"`
+	ReloadCmd string                 `toml:"reload_cmd"`
+	Daemon    config.DaemonConfig    `toml:"daemon"`
+	S3        config.S3Config        `toml:"s3"`
+	Sources   []config.StorageConfig `toml:"sources,omitempty"`
+}
+
+// s3Credentials are the S3 credentials of a client for one storage
+type s3Credentials struct {
+	accessKey string
+	secretKey string
+}
+
+// parseCredentials parses name=ACCESS_KEY:SECRET_KEY as given to
+// --credentials
+func parseCredentials(value string) (string, s3Credentials, error) {
+	name, keys, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return "", s3Credentials{}, fmt.Errorf("invalid credentials %q, expected name=ACCESS_KEY:SECRET_KEY", value)
+	}
+	accessKey, secretKey, ok := strings.Cut(keys, ":")
+	if !ok || accessKey == "" || secretKey == "" {
+		return "", s3Credentials{}, fmt.Errorf("invalid credentials for %s, expected name=ACCESS_KEY:SECRET_KEY", name)
+	}
+	return name, s3Credentials{accessKey: accessKey, secretKey: secretKey}, nil
+}
+
+// enroll builds a bundle for a new pull host containing the keys of the
+// selected certificates and a pull configuration for the same buckets. The
+// push host's S3 credentials are never bundled; every bucket gets the
+// credentials in creds under its storage name, "s3" for [s3], or empty
+// ones to fill in later.
+func enroll(cfg *config.PushConfig, client string, certNames []string, creds map[string]s3Credentials) (*bundle.Bundle, error) {
+	if cfg.KeyProvider.Type != "" && cfg.KeyProvider.Type != "local" {
+		return nil, fmt.Errorf("enroll requires the local key provider")
+	}
+
+	passphrase, err := cfg.KeyPassphrase.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load key passphrase: %w", err)
+	}
+
+	// S3 destinations become fallback sources. Filesystem destinations are
+	// left out as their paths are local to the push server.
+	var (
+		s3Cfg   config.S3Config
+		sources []config.StorageConfig
+		buckets = make(map[string]bool)
+	)
+	for i, st := range cfg.Storages() {
+		if st.Path != "" || st.S3.Bucket == "" {
+			continue
+		}
+		buckets[st.Name] = true
+		st.S3.AccessKey, st.S3.SecretKey = creds[st.Name].accessKey, creds[st.Name].secretKey
+		if i == 0 && cfg.S3.Bucket != "" {
+			s3Cfg = st.S3
+		} else {
+			sources = append(sources, st)
+		}
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("enroll requires an S3 bucket, filesystem destinations are local to the push server")
+	}
+	for name := range creds {
+		if !buckets[name] {
+			return nil, fmt.Errorf("credentials for %q, which is not an S3 storage", name)
+		}
+	}
+
+	pullCfg, err := toml.Marshal(enrollPullConfig{
+		KeyDir:  defaultKeyDir,
+		CertDir: defaultCertDir,
+		Daemon:  config.DaemonConfig{IntervalSecs: 300},
+		S3:      s3Cfg,
+		Sources: sources,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal pull config: %w", err)
+	}
+
+	b := &bundle.Bundle{
+		Client:     client,
+		PullConfig: string(pullCfg),
+	}
+
+	for _, certName := range certNames {
+		if err := manifest.ValidFileName(certName); err != nil {
+			return nil, fmt.Errorf("invalid certificate name: %w", err)
+		}
+
+		key, err := config.LoadKey(cfg.KeyDir, certName, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		b.AddKey(certName, key)
+	}
+
+	return b, nil
+}
+
+// importBundle installs the keys of a bundle into the key directory of
+// the pull configuration at configPath. The bundled configuration is only
+// written if there is no configuration at configPath yet.
+func importBundle(configPath string, b *bundle.Bundle) error {
+	if _, err := os.Stat(configPath); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+			return fmt.Errorf("create config directory: %w", err)
+		}
+		// The config contains S3 credentials
+		if err := os.WriteFile(configPath, []byte(b.PullConfig), 0600); err != nil {
+			return fmt.Errorf("write config file: %w", err)
+		}
+		log.Printf("wrote %s", configPath)
+	} else {
+		log.Printf("keeping existing %s", configPath)
+	}
+
+	cfg, err := config.LoadPull(configPath)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := cfg.KeyPassphrase.Load()
+	if err != nil {
+		return fmt.Errorf("load key passphrase: %w", err)
+	}
+
+	// Key names become file names in key_dir
+	for certName := range b.Keys {
+		if err := manifest.ValidFileName(certName); err != nil {
+			return fmt.Errorf("invalid certificate name in bundle: %w", err)
+		}
+	}
+
+	for certName := range b.Keys {
+		key, err := b.Key(certName)
+		if err != nil {
+			return err
+		}
+
+		if err := config.SaveKey(cfg.KeyDir, certName, key, passphrase); err != nil {
+			return err
+		}
+
+		log.Printf("imported key for %s", certName)
+	}
+
+	return nil
+}
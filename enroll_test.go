@@ -0,0 +1,151 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/bundle"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/pelletier/go-toml/v2"
+)
+
+func TestEnrollOmitsPushCredentials(t *testing.T) {
+	keyDir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	if err := config.SaveKey(keyDir, "a.example.com", key, nil); err != nil {
+		t.Fatalf("SaveKey failed: %v", err)
+	}
+
+	cfg := &config.PushConfig{
+		KeyDir: keyDir,
+		S3:     config.S3Config{Bucket: "certs", AccessKey: "push-key", SecretKey: "push-secret"},
+		Destinations: []config.StorageConfig{
+			{Name: "backup", S3: config.S3Config{Bucket: "backup", AccessKey: "push-key", SecretKey: "push-secret"}},
+			{Name: "mirror", Path: "/mnt/certificates"},
+		},
+	}
+
+	b, err := enroll(cfg, "web1", []string{"a.example.com"}, map[string]s3Credentials{
+		"s3":     {accessKey: "ro-key", secretKey: "ro-secret"},
+		"backup": {accessKey: "backup-key", secretKey: "backup-secret"},
+	})
+	if err != nil {
+		t.Fatalf("enroll failed: %v", err)
+	}
+	if strings.Contains(b.PullConfig, "push-") {
+		t.Errorf("Bundle contains push credentials:\n%s", b.PullConfig)
+	}
+
+	var pullCfg enrollPullConfig
+	if err := toml.Unmarshal([]byte(b.PullConfig), &pullCfg); err != nil {
+		t.Fatalf("Failed to parse pull config: %v", err)
+	}
+	if pullCfg.S3.AccessKey != "ro-key" || pullCfg.S3.SecretKey != "ro-secret" {
+		t.Errorf("Unexpected S3 credentials %+v", pullCfg.S3)
+	}
+	if len(pullCfg.Sources) != 1 || pullCfg.Sources[0].S3.AccessKey != "backup-key" || pullCfg.Sources[0].S3.SecretKey != "backup-secret" {
+		t.Errorf("Unexpected sources %+v", pullCfg.Sources)
+	}
+
+	if got, err := b.Key("a.example.com"); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("Unexpected bundled key %x, %v", got, err)
+	}
+
+	if _, err := enroll(cfg, "web1", []string{"../a.example.com"}, nil); err == nil {
+		t.Error("enroll accepted a certificate name outside key_dir")
+	}
+
+	// Credentials must belong to an S3 storage
+	if _, err := enroll(cfg, "web1", []string{"a.example.com"}, map[string]s3Credentials{"mirror": {"key", "secret"}}); err == nil {
+		t.Error("enroll accepted credentials for a filesystem destination")
+	}
+}
+
+func TestEnrollRequiresBucket(t *testing.T) {
+	keyDir := t.TempDir()
+	if err := config.SaveKey(keyDir, "a.example.com", bytes.Repeat([]byte{1}, 32), nil); err != nil {
+		t.Fatalf("SaveKey failed: %v", err)
+	}
+
+	// Filesystem destinations are local to the push server, so the pull
+	// config would have no storage
+	cfg := &config.PushConfig{
+		KeyDir:       keyDir,
+		Destinations: []config.StorageConfig{{Name: "mirror", Path: "/mnt/certificates"}},
+	}
+	if _, err := enroll(cfg, "web1", []string{"a.example.com"}, nil); err == nil {
+		t.Error("enroll accepted a push config without bucket")
+	}
+
+	// A bucket among the destinations is enough
+	cfg.Destinations = append(cfg.Destinations, config.StorageConfig{Name: "backup", S3: config.S3Config{Bucket: "backup"}})
+	b, err := enroll(cfg, "web1", []string{"a.example.com"}, nil)
+	if err != nil {
+		t.Fatalf("enroll failed: %v", err)
+	}
+	var pullCfg enrollPullConfig
+	if err := toml.Unmarshal([]byte(b.PullConfig), &pullCfg); err != nil {
+		t.Fatalf("Failed to parse pull config: %v", err)
+	}
+	if pullCfg.S3.Bucket != "" || len(pullCfg.Sources) != 1 || pullCfg.Sources[0].S3.Bucket != "backup" {
+		t.Errorf("Unexpected storages %+v, %+v", pullCfg.S3, pullCfg.Sources)
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	name, c, err := parseCredentials("backup=AKIA123:se=cr/et")
+	if err != nil || name != "backup" || c.accessKey != "AKIA123" || c.secretKey != "se=cr/et" {
+		t.Errorf("Unexpected credentials %q, %+v, %v", name, c, err)
+	}
+
+	for _, value := range []string{"backup", "=key:secret", "backup=key", "backup=:secret", "backup=key:"} {
+		if _, _, err := parseCredentials(value); err == nil {
+			t.Errorf("parseCredentials(%q) succeeded", value)
+		}
+	}
+}
+
+func TestImportBundleRejectsUnsafeNames(t *testing.T) {
+	dir := t.TempDir()
+	keyDir := filepath.Join(dir, "keys")
+	configPath := filepath.Join(dir, "pull.toml")
+	pullCfg := "key_dir = '" + keyDir + "'\ncert_dir = '" + filepath.Join(dir, "certs") + "'\n[s3]\nbucket = 'certs'\n"
+	if err := os.WriteFile(configPath, []byte(pullCfg), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	for _, name := range []string{"../escaped", "sub/dir", ".hidden"} {
+		b := &bundle.Bundle{Client: "web1"}
+		b.AddKey("a.example.com", bytes.Repeat([]byte{1}, 32))
+		b.AddKey(name, bytes.Repeat([]byte{2}, 32))
+
+		if err := importBundle(configPath, b); err == nil {
+			t.Errorf("importBundle accepted key name %q", name)
+		}
+	}
+
+	// Nothing is imported from a rejected bundle
+	if entries, _ := os.ReadDir(keyDir); len(entries) != 0 {
+		t.Errorf("Keys were imported from rejected bundles: %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.pushpuller-key")); err == nil {
+		t.Error("Key was written outside key_dir")
+	}
+}
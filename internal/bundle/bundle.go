@@ -0,0 +1,94 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bundle
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/crypto"
+)
+
+// Bundle carries everything a new pull host needs: the keys of the
+// certificates it may decrypt and a ready to use pull configuration
+type Bundle struct {
+	Client     string            `json:"client"`
+	PullConfig string            `json:"pull_config"`
+	Keys       map[string]string `json:"keys"`
+}
+
+// AddKey adds the key for certName to the bundle
+func (b *Bundle) AddKey(certName string, key []byte) {
+	if b.Keys == nil {
+		b.Keys = make(map[string]string)
+	}
+	b.Keys[certName] = base64.StdEncoding.EncodeToString(key)
+}
+
+// Key returns the decoded key for certName
+func (b *Bundle) Key(certName string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(b.Keys[certName])
+	if err != nil {
+		return nil, fmt.Errorf("decode key for %s: %w", certName, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key for %s: invalid size %d bytes (expected 32)", certName, len(key))
+	}
+	return key, nil
+}
+
+// Encode serializes the bundle. If passphrase is non-empty the bundle is
+// encrypted with it, otherwise it is plain JSON.
+func Encode(b *Bundle, passphrase []byte) ([]byte, error) {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal bundle: %w", err)
+	}
+
+	if len(passphrase) > 0 {
+		sealed, err := crypto.WrapKey(data, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt bundle: %w", err)
+		}
+		data = []byte(sealed)
+	}
+
+	return append(data, '\n'), nil
+}
+
+// Decode parses a bundle produced by Encode
+func Decode(data []byte, passphrase []byte) (*Bundle, error) {
+	text := strings.TrimSpace(string(data))
+
+	if crypto.IsWrappedKey(text) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("bundle is encrypted but no passphrase was given")
+		}
+		opened, err := crypto.UnwrapKey(text, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt bundle: %w", err)
+		}
+		data = opened
+	}
+
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("parse bundle: %w", err)
+	}
+
+	return &b, nil
+}
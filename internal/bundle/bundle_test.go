@@ -0,0 +1,66 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bundle
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	b := &Bundle{Client: "web1", PullConfig: "key_dir = '/keys'\n"}
+	b.AddKey("_.example.com", key)
+
+	for _, passphrase := range [][]byte{nil, []byte("bundle-pass")} {
+		data, err := Encode(b, passphrase)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+
+		if passphrase != nil && bytes.Contains(data, []byte("_.example.com")) {
+			t.Error("Encrypted bundle should not contain certificate names")
+		}
+
+		decoded, err := Decode(data, passphrase)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+
+		if decoded.Client != b.Client || decoded.PullConfig != b.PullConfig {
+			t.Errorf("Decoded bundle doesn't match: %+v", decoded)
+		}
+
+		decodedKey, err := decoded.Key("_.example.com")
+		if err != nil {
+			t.Fatalf("Key failed: %v", err)
+		}
+
+		if !bytes.Equal(decodedKey, key) {
+			t.Error("Decoded key doesn't match original")
+		}
+	}
+
+	// Encrypted bundles require the passphrase
+	data, err := Encode(b, []byte("bundle-pass"))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	if _, err := Decode(data, nil); err == nil {
+		t.Error("Decode should fail without passphrase")
+	}
+}
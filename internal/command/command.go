@@ -15,16 +15,103 @@
 package command
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
-// RunCommandWithEnv runs a shell command with optional environment variables
-func RunCommandWithEnv(cmdStr string, env map[string]string) error {
-	cmd := exec.Command("sh", "-c", cmdStr)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// redacted replaces secret values in command output
+const redacted = "[REDACTED]"
+
+// outputDrain is how long output is still read after the command exited or
+// was killed. Background processes it started may keep the output open.
+const outputDrain = time.Second
+
+// terminateGrace is how long the process group may take to exit after
+// SIGTERM before it is killed
+const terminateGrace = 5 * time.Second
+
+// maxLineLength splits longer output lines so a command can't grow the
+// buffer without bounds
+const maxLineLength = 64 * 1024
+
+// Options controls timeouts and retries of a command
+type Options struct {
+	// Timeout limits each attempt; zero means no limit
+	Timeout time.Duration
+	// Retries is the number of additional attempts after a failure
+	Retries int
+	// RetryDelay is the wait between attempts
+	RetryDelay time.Duration
+}
+
+// RunCommandWithRetries runs a shell command like RunCommandWithEnv, killing
+// it after opts.Timeout and retrying failed attempts up to opts.Retries
+// times. It stops early once ctx is done.
+func RunCommandWithRetries(ctx context.Context, logger *slog.Logger, cmdStr string, env map[string]string, opts Options) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var err error
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if attempt > 0 {
+			logger.Warn("retrying command", "attempt", attempt+1, "retry_delay", opts.RetryDelay, "error", err)
+			select {
+			case <-time.After(opts.RetryDelay):
+			case <-ctx.Done():
+				return err
+			}
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		err = RunCommandWithEnv(attemptCtx, logger, cmdStr, env)
+		timedOut := errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+		if timedOut {
+			err = fmt.Errorf("timed out after %s: %w", opts.Timeout, err)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// RunCommandWithEnv runs a shell command with optional environment variables.
+// The command's output is logged line by line through logger (slog.Default
+// if nil), with the values of env redacted. The command runs in its own
+// process group, which is terminated as a whole once ctx is done.
+func RunCommandWithEnv(ctx context.Context, logger *slog.Logger, cmdStr string, env map[string]string) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// Stop children like lego as well, not just the shell
+		return terminateGroup(cmd.Process.Pid, terminateGrace)
+	}
+	// Don't wait for output from background processes that outlive the
+	// command, e.g. a daemon started by a reload script
+	cmd.WaitDelay = outputDrain
 
 	// Always inherit parent environment and add/override custom variables
 	if len(env) > 0 {
@@ -35,5 +122,126 @@ func RunCommandWithEnv(cmdStr string, env map[string]string) error {
 	}
 	// If env is nil or empty, cmd.Env stays nil which means inherit parent env
 
-	return cmd.Run()
+	// os/exec copies the output into the writers, so Wait only waits
+	// outputDrain for it once the command is gone
+	redact := newRedactor(env)
+	stdout := &lineWriter{logger: logger, stream: "stdout", redact: redact}
+	stderr := &lineWriter{logger: logger, stream: "stderr", redact: redact}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// The command line is not logged as it may contain credentials
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		logger.Error("command failed to start", "error", err)
+		return err
+	}
+
+	err := cmd.Wait()
+	stdout.flush()
+	stderr.flush()
+
+	// The command itself succeeded; only its background processes are
+	// still running
+	if errors.Is(err, exec.ErrWaitDelay) {
+		logger.Warn("command left background processes holding its output open")
+		err = nil
+	}
+
+	logger.Info("command finished", "exit_code", ExitCode(err), "duration", time.Since(start))
+
+	return err
+}
+
+// terminateGroup sends SIGTERM to the process group, so lego can e.g. remove
+// its DNS challenge records, and kills it if it is still running after grace
+func terminateGroup(pgid int, grace time.Duration) error {
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if syscall.Kill(-pgid, 0) != nil {
+			return nil
+		}
+	}
+	return syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// lineWriter logs the output written to it line by line. It is used by a
+// single copying goroutine, so it needs no locking.
+type lineWriter struct {
+	logger *slog.Logger
+	stream string
+	redact func(string) string
+	buf    []byte
+}
+
+// Write logs every complete line in p and keeps the rest for later
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+
+	for len(w.buf) >= maxLineLength {
+		w.log(w.buf[:maxLineLength])
+		w.buf = w.buf[maxLineLength:]
+	}
+	return len(p), nil
+}
+
+// flush logs a final line without newline
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.log(w.buf)
+		w.buf = nil
+	}
+}
+
+// log logs one line
+func (w *lineWriter) log(line []byte) {
+	w.logger.Info("command output", "stream", w.stream, "line", w.redact(strings.TrimSuffix(string(line), "\r")))
+}
+
+// newRedactor returns a function replacing the non-empty values of env
+// in a line, longest first so overlapping secrets are fully hidden
+func newRedactor(env map[string]string) func(string) string {
+	var secrets []string
+	for _, v := range env {
+		if v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	return func(line string) string {
+		for _, secret := range secrets {
+			line = strings.ReplaceAll(line, secret, redacted)
+		}
+		return line
+	}
+}
+
+// ExitCode returns the exit code of a command run that returned err:
+// 0 on success, the process exit code if it ran, or -1 if it failed to run
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
 }
@@ -15,9 +15,16 @@
 package command
 
 import (
+	"context"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestRunCommandWithEnvVariables(t *testing.T) {
@@ -29,7 +36,7 @@ func TestRunCommandWithEnvVariables(t *testing.T) {
 
 	// Write env var to file
 	cmd := "echo $TEST_VAR > " + tmpFile
-	err := RunCommandWithEnv(cmd, env)
+	err := RunCommandWithEnv(context.Background(), nil, cmd, env)
 	if err != nil {
 		t.Fatalf("RunCommandWithEnv failed: %v", err)
 	}
@@ -45,3 +52,212 @@ func TestRunCommandWithEnvVariables(t *testing.T) {
 		t.Errorf("Expected 'test_value', got '%s'", output)
 	}
 }
+
+// recordHandler collects log records for inspection
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordHandler) attrs(msg string) []map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []map[string]string
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]string)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		out = append(out, attrs)
+	}
+	return out
+}
+
+func TestRunCommandCapturesOutput(t *testing.T) {
+	handler := &recordHandler{}
+	logger := slog.New(handler)
+
+	env := map[string]string{
+		"API_TOKEN": "supersecret",
+	}
+
+	cmd := "echo token is $API_TOKEN; echo oops >&2; exit 3"
+	err := RunCommandWithEnv(context.Background(), logger, cmd, env)
+	if ExitCode(err) != 3 {
+		t.Fatalf("Expected exit code 3, got %v", err)
+	}
+
+	lines := handler.attrs("command output")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 output lines, got %v", lines)
+	}
+
+	for _, line := range lines {
+		if strings.Contains(line["line"], "supersecret") {
+			t.Errorf("Secret was not redacted: %q", line["line"])
+		}
+		switch line["stream"] {
+		case "stdout":
+			if line["line"] != "token is [REDACTED]" {
+				t.Errorf("Unexpected stdout line %q", line["line"])
+			}
+		case "stderr":
+			if line["line"] != "oops" {
+				t.Errorf("Unexpected stderr line %q", line["line"])
+			}
+		default:
+			t.Errorf("Unexpected stream %q", line["stream"])
+		}
+	}
+
+	finished := handler.attrs("command finished")
+	if len(finished) != 1 || finished[0]["exit_code"] != "3" || finished[0]["duration"] == "" {
+		t.Errorf("Unexpected command finished record: %v", finished)
+	}
+}
+
+func TestRunCommandTimeoutKillsProcessGroup(t *testing.T) {
+	tmpFile := t.TempDir() + "/survived.txt"
+
+	// The background sleep is a grandchild that must die with the shell
+	cmd := "(sleep 1; touch " + tmpFile + ") & sleep 30"
+	start := time.Now()
+	err := RunCommandWithRetries(context.Background(), nil, cmd, nil, Options{Timeout: 200 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > terminateGrace {
+		t.Errorf("Command was not killed on timeout, took %s", elapsed)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(tmpFile); err == nil {
+		t.Error("Child process survived the timeout")
+	}
+}
+
+// detachedSleep returns a shell command starting a sleep in its own
+// session, which is killed when the test ends
+func detachedSleep(t *testing.T) string {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	t.Cleanup(func() {
+		if data, err := os.ReadFile(pidFile); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	})
+	return "setsid sh -c 'echo $$ > " + pidFile + "; exec sleep 10' &"
+}
+
+func TestRunCommandTimeoutTerminatesGracefully(t *testing.T) {
+	handler := &recordHandler{}
+	logger := slog.New(handler)
+
+	// The command gets to clean up before it is killed
+	cmd := "trap 'echo cleanup; exit 1' TERM; sleep 5 & wait"
+	start := time.Now()
+	err := RunCommandWithRetries(context.Background(), logger, cmd, nil, Options{Timeout: 200 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > terminateGrace {
+		t.Errorf("Command did not exit on SIGTERM, took %s", elapsed)
+	}
+
+	lines := handler.attrs("command output")
+	if len(lines) != 1 || lines[0]["line"] != "cleanup" {
+		t.Errorf("Expected output of the trap, got %v", lines)
+	}
+}
+
+func TestRunCommandDetachedChild(t *testing.T) {
+	handler := &recordHandler{}
+	logger := slog.New(handler)
+
+	// The detached sleep leaves its own session, so it is not killed with
+	// the process group and keeps the output open
+	cmd := detachedSleep(t) + " echo started"
+	start := time.Now()
+	err := RunCommandWithEnv(context.Background(), logger, cmd, nil)
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > outputDrain+time.Second {
+		t.Errorf("Waited for the detached child, took %s", elapsed)
+	}
+
+	lines := handler.attrs("command output")
+	if len(lines) != 1 || lines[0]["line"] != "started" {
+		t.Errorf("Expected output of the command, got %v", lines)
+	}
+}
+
+func TestRunCommandDetachedChildTimeout(t *testing.T) {
+	cmd := detachedSleep(t) + " echo started; sleep 30"
+	start := time.Now()
+	err := RunCommandWithRetries(context.Background(), nil, cmd, nil, Options{Timeout: 200 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > terminateGrace+outputDrain {
+		t.Errorf("Timeout did not apply, took %s", elapsed)
+	}
+}
+
+func TestRunCommandLongLine(t *testing.T) {
+	handler := &recordHandler{}
+	logger := slog.New(handler)
+
+	cmd := "head -c 100000 /dev/zero | tr '\\0' x; printf '\\nlast'"
+	if err := RunCommandWithEnv(context.Background(), logger, cmd, nil); err != nil {
+		t.Fatalf("RunCommandWithEnv failed: %v", err)
+	}
+
+	lines := handler.attrs("command output")
+	total := 0
+	for _, line := range lines {
+		if len(line["line"]) > maxLineLength {
+			t.Errorf("Line longer than %d bytes: %d", maxLineLength, len(line["line"]))
+		}
+		total += len(line["line"])
+	}
+	if total != 100000+len("last") || lines[len(lines)-1]["line"] != "last" {
+		t.Errorf("Unexpected output: %d bytes in %d lines", total, len(lines))
+	}
+}
+
+func TestRunCommandRetries(t *testing.T) {
+	counter := t.TempDir() + "/attempts"
+
+	// Fails twice, then succeeds
+	cmd := "echo x >> " + counter + "; [ $(wc -l < " + counter + ") -ge 3 ]"
+	err := RunCommandWithRetries(context.Background(), nil, cmd, nil, Options{Retries: 2, RetryDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected success on third attempt, got %v", err)
+	}
+
+	// Gives up once retries are exhausted
+	os.Remove(counter)
+	err = RunCommandWithRetries(context.Background(), nil, cmd, nil, Options{Retries: 1, RetryDelay: 10 * time.Millisecond})
+	if ExitCode(err) != 1 {
+		t.Errorf("Expected exit code 1 after retries, got %v", err)
+	}
+}
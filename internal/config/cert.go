@@ -14,7 +14,15 @@
 
 package config
 
-import "strings"
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
 
 // ExtractCertName extracts the certificate name from a filename
 // Returns certificate name and true if the file is a certificate or key file
@@ -28,3 +36,45 @@ func ExtractCertName(fileName string) (string, bool) {
 	}
 	return "", false
 }
+
+// CertificateExpiry returns the NotAfter time of the first certificate in
+// every .crt file (excluding issuer certificates) in certDir, keyed by
+// certificate name. Files that do not contain a certificate are skipped.
+func CertificateExpiry(certDir string) (map[string]time.Time, error) {
+	entries, err := os.ReadDir(certDir)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate directory %s: %w", certDir, err)
+	}
+
+	expiry := make(map[string]time.Time)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".crt") {
+			continue
+		}
+
+		certName, ok := ExtractCertName(name)
+		if !ok {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(certDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		expiry[certName] = cert.NotAfter
+	}
+
+	return expiry, nil
+}
@@ -15,13 +15,13 @@
 package config
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/schedule"
 	"github.com/pelletier/go-toml/v2"
 )
 
@@ -35,32 +35,205 @@ type S3Config struct {
 	SecretKey      string `toml:"secret_key"`
 }
 
+// StorageConfig is a location certificates are pushed to or pulled from in
+// addition to the [s3] table, either an S3 bucket or the directory at Path
+type StorageConfig struct {
+	Name string   `toml:"name,omitempty"`
+	Path string   `toml:"path,omitempty"`
+	S3   S3Config `toml:"s3"`
+}
+
+// defaultName returns the name used in logs and metrics if none is set
+func (s StorageConfig) defaultName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.Path != "" {
+		return s.Path
+	}
+	return "s3://" + s.S3.Bucket
+}
+
+// storages returns the [s3] table named "s3" followed by extra with
+// default names. The [s3] table is left out if it has no bucket and extra
+// storages are configured.
+func storages(primary S3Config, extra []StorageConfig) []StorageConfig {
+	var result []StorageConfig
+	if primary.Bucket != "" || len(extra) == 0 {
+		result = append(result, StorageConfig{Name: "s3", S3: primary})
+	}
+	for _, s := range extra {
+		s.Name = s.defaultName()
+		result = append(result, s)
+	}
+	return result
+}
+
+// validateStorages checks that every extra storage is either a bucket or a
+// directory and that all names are unique
+func validateStorages(kind string, primary S3Config, extra []StorageConfig) error {
+	for i, s := range extra {
+		if (s.Path == "") == (s.S3.Bucket == "") {
+			return fmt.Errorf("%s %d: exactly one of path and s3.bucket is required", kind, i+1)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, s := range storages(primary, extra) {
+		if names[s.Name] {
+			return fmt.Errorf("%s: duplicate name %q", kind, s.Name)
+		}
+		names[s.Name] = true
+	}
+	return nil
+}
+
 type LegoCommand struct {
-	Command string            `toml:"command"`
-	Env     map[string]string `toml:"env"`
+	Command        string            `toml:"command"`
+	Env            map[string]string `toml:"env"`
+	TimeoutSecs    int               `toml:"timeout_secs"`
+	Retries        int               `toml:"retries"`
+	RetryDelaySecs int               `toml:"retry_delay_secs"`
+}
+
+// ReloadConfig limits and retries the reload command
+type ReloadConfig struct {
+	TimeoutSecs    int `toml:"timeout_secs"`
+	Retries        int `toml:"retries"`
+	RetryDelaySecs int `toml:"retry_delay_secs"`
 }
 
 type DaemonConfig struct {
+	Enabled           bool   `toml:"enabled"`
+	IntervalSecs      int    `toml:"interval_secs"`
+	JitterSecs        int    `toml:"jitter_secs"`
+	Cron              string `toml:"cron"`
+	Window            string `toml:"window"`
+	RetryMaxAttempts  int    `toml:"retry_max_attempts"`
+	RetryBackoffSecs  int    `toml:"retry_backoff_secs"`
+	Listen            string `toml:"listen"`
+	ReadyIntervals    int    `toml:"ready_intervals"`
+	ShutdownGraceSecs int    `toml:"shutdown_grace_secs"`
+}
+
+// WatchConfig makes the push daemon upload certificates as soon as files
+// in cert_dir have stopped changing for DebounceSecs
+type WatchConfig struct {
 	Enabled      bool `toml:"enabled"`
-	IntervalSecs int  `toml:"interval_secs"`
-	JitterSecs   int  `toml:"jitter_secs"`
+	DebounceSecs int  `toml:"debounce_secs"`
+}
+
+// TriggerConfig enables the /trigger endpoint of the pull daemon, which
+// runs a pull immediately. Requests must be signed with Secret or carry
+// Token as a bearer token.
+type TriggerConfig struct {
+	Secret PassphraseConfig `toml:"secret"`
+	Token  PassphraseConfig `toml:"token"`
+}
+
+// Enabled reports whether a secret or token is configured
+func (t TriggerConfig) Enabled() bool {
+	return t.Secret != PassphraseConfig{} || t.Token != PassphraseConfig{}
+}
+
+// NotifyConfig is a pull daemon trigger endpoint push calls after updating
+// the manifest
+type NotifyConfig struct {
+	URL         string           `toml:"url"`
+	Secret      PassphraseConfig `toml:"secret"`
+	TimeoutSecs int              `toml:"timeout_secs"`
+}
+
+// LogConfig configures log output. Format is "text" (default) or "json",
+// level is one of "debug", "info" (default), "warn" or "error".
+type LogConfig struct {
+	Format string `toml:"format"`
+	Level  string `toml:"level"`
+}
+
+// MetricsConfig configures metrics output for timer based runs
+type MetricsConfig struct {
+	TextfileDir string `toml:"textfile_dir"`
+}
+
+// PassphraseConfig selects where the key wrapping passphrase is read from.
+// At most one source should be set; if none is set keys are stored unwrapped.
+type PassphraseConfig struct {
+	File       string `toml:"file"`
+	Env        string `toml:"env"`
+	Credential string `toml:"credential"`
+}
+
+// VaultConfig configures the HashiCorp Vault Transit key provider
+type VaultConfig struct {
+	Address string `toml:"address"`
+	Token   string `toml:"token"`
+	Mount   string `toml:"mount"`
+	KeyName string `toml:"key_name"`
+}
+
+// AWSKMSConfig configures the AWS KMS key provider
+type AWSKMSConfig struct {
+	KeyID     string `toml:"key_id"`
+	Region    string `toml:"region"`
+	Endpoint  string `toml:"endpoint"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+}
+
+// KeyProviderConfig selects how per-object data keys are protected.
+// Type is one of "local" (default), "vault" or "awskms".
+type KeyProviderConfig struct {
+	Type   string       `toml:"type"`
+	Vault  VaultConfig  `toml:"vault"`
+	AWSKMS AWSKMSConfig `toml:"awskms"`
 }
 
 type PushConfig struct {
-	KeyDir       string        `toml:"key_dir"`
-	CertDir      string        `toml:"cert_dir"`
-	LegoCommands []LegoCommand `toml:"lego_commands"`
-	ReloadCmd    string        `toml:"reload_cmd"`
-	S3           S3Config      `toml:"s3"`
-	Daemon       DaemonConfig  `toml:"daemon"`
+	KeyDir             string            `toml:"key_dir"`
+	CertDir            string            `toml:"cert_dir"`
+	PusherID           string            `toml:"pusher_id"`
+	LegoCommands       []LegoCommand     `toml:"lego_commands"`
+	Concurrency        int               `toml:"concurrency"`
+	Prune              bool              `toml:"prune"`
+	PruneRetentionSecs int               `toml:"prune_retention_secs"`
+	GCGraceSecs        int               `toml:"gc_grace_secs"`
+	ReloadCmd          string            `toml:"reload_cmd"`
+	Reload             ReloadConfig      `toml:"reload"`
+	KeyPassphrase      PassphraseConfig  `toml:"key_passphrase"`
+	KeyProvider        KeyProviderConfig `toml:"key_provider"`
+	S3                 S3Config          `toml:"s3"`
+	Destinations       []StorageConfig   `toml:"destinations"`
+	Daemon             DaemonConfig      `toml:"daemon"`
+	Watch              WatchConfig       `toml:"watch"`
+	Notify             []NotifyConfig    `toml:"notify"`
+	Metrics            MetricsConfig     `toml:"metrics"`
+	Log                LogConfig         `toml:"log"`
 }
 
 type PullConfig struct {
-	KeyDir    string       `toml:"key_dir"`
-	CertDir   string       `toml:"cert_dir"`
-	ReloadCmd string       `toml:"reload_cmd"`
-	S3        S3Config     `toml:"s3"`
-	Daemon    DaemonConfig `toml:"daemon"`
+	KeyDir          string            `toml:"key_dir"`
+	CertDir         string            `toml:"cert_dir"`
+	Concurrency     int               `toml:"concurrency"`
+	Prune           bool              `toml:"prune"`
+	PruneArchiveDir string            `toml:"prune_archive_dir"`
+	ReloadCmd       string            `toml:"reload_cmd"`
+	Reload          ReloadConfig      `toml:"reload"`
+	KeyPassphrase   PassphraseConfig  `toml:"key_passphrase"`
+	KeyProvider     KeyProviderConfig `toml:"key_provider"`
+	S3              S3Config          `toml:"s3"`
+	Sources         []StorageConfig   `toml:"sources"`
+	Daemon          DaemonConfig      `toml:"daemon"`
+	Trigger         TriggerConfig     `toml:"trigger"`
+	Metrics         MetricsConfig     `toml:"metrics"`
+	Log             LogConfig         `toml:"log"`
+}
+
+// KeyConfig holds the key related fields shared by push and pull configs
+type KeyConfig struct {
+	KeyDir        string           `toml:"key_dir"`
+	CertDir       string           `toml:"cert_dir"`
+	KeyPassphrase PassphraseConfig `toml:"key_passphrase"`
 }
 
 // LoadPush loads the push configuration from a TOML file
@@ -75,9 +248,37 @@ func LoadPush(configPath string) (*PushConfig, error) {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
 
+	if err := checkDirsOverlap(cfg.KeyDir, cfg.CertDir); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Daemon.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Watch.Enabled && !cfg.Daemon.Enabled {
+		return nil, fmt.Errorf("watch requires daemon.enabled")
+	}
+
+	for i, n := range cfg.Notify {
+		if n.URL == "" || n.Secret == (PassphraseConfig{}) {
+			return nil, fmt.Errorf("notify %d: url and secret are required", i+1)
+		}
+	}
+
+	if err := validateStorages("destinations", cfg.S3, cfg.Destinations); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
+// Storages returns all locations push publishes to: the [s3] table
+// followed by the configured destinations
+func (c *PushConfig) Storages() []StorageConfig {
+	return storages(c.S3, c.Destinations)
+}
+
 // LoadPull loads the pull configuration from a TOML file
 func LoadPull(configPath string) (*PullConfig, error) {
 	data, err := os.ReadFile(configPath)
@@ -90,72 +291,181 @@ func LoadPull(configPath string) (*PullConfig, error) {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
 
+	if err := checkDirsOverlap(cfg.KeyDir, cfg.CertDir); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Daemon.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Trigger.Enabled() && (!cfg.Daemon.Enabled || cfg.Daemon.Listen == "") {
+		return nil, fmt.Errorf("trigger requires daemon.enabled and daemon.listen")
+	}
+
+	if err := validateStorages("sources", cfg.S3, cfg.Sources); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
-// GenerateKey generates a random 32-byte key for encryption
-func GenerateKey() ([]byte, error) {
-	key := make([]byte, 32)
-	if _, err := rand.Read(key); err != nil {
-		return nil, fmt.Errorf("generate random key: %w", err)
-	}
-	return key, nil
+// Storages returns the locations pull reads from in order of preference:
+// the [s3] table followed by the configured sources
+func (c *PullConfig) Storages() []StorageConfig {
+	return storages(c.S3, c.Sources)
 }
 
-// SaveKey saves the encryption key to a .key file as base64
-func SaveKey(keyDir, certName string, key []byte) error {
-	if err := os.MkdirAll(keyDir, 0700); err != nil {
-		return fmt.Errorf("create key directory: %w", err)
+// LoadKeyConfig loads only the key related fields from a push or pull
+// configuration file
+func LoadKeyConfig(configPath string) (*KeyConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
 	}
 
-	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
-	keyFile := filepath.Join(keyDir, certName+".key")
-	if err := os.WriteFile(keyFile, []byte(encoded), 0600); err != nil {
-		return fmt.Errorf("write key file %s: %w", keyFile, err)
+	var cfg KeyConfig
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
 	}
 
-	return nil
+	if err := checkDirsOverlap(cfg.KeyDir, cfg.CertDir); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
 }
 
-// LoadKey loads the encryption key from a .key file (base64 encoded)
-func LoadKey(keyDir, certName string) ([]byte, error) {
-	keyFile := filepath.Join(keyDir, certName+".key")
-	data, err := os.ReadFile(keyFile)
-	if err != nil {
-		return nil, fmt.Errorf("read key file %s: %w", keyFile, err)
+// Load reads the passphrase from the configured source.
+// Returns nil if no source is configured.
+func (p PassphraseConfig) Load() ([]byte, error) {
+	var data []byte
+	switch {
+	case p.File != "":
+		b, err := os.ReadFile(p.File)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase file: %w", err)
+		}
+		data = b
+	case p.Env != "":
+		v, ok := os.LookupEnv(p.Env)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s is not set", p.Env)
+		}
+		data = []byte(v)
+	case p.Credential != "":
+		// systemd exposes credentials from LoadCredential= in this directory
+		credDir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if credDir == "" {
+			return nil, fmt.Errorf("passphrase credential %s: CREDENTIALS_DIRECTORY is not set", p.Credential)
+		}
+		b, err := os.ReadFile(filepath.Join(credDir, p.Credential))
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase credential: %w", err)
+		}
+		data = b
+	default:
+		return nil, nil
 	}
 
-	// Trim whitespace (including newline)
-	encoded := strings.TrimSpace(string(data))
+	passphrase := []byte(strings.TrimRight(string(data), "\r\n"))
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	return passphrase, nil
+}
 
-	decoded, err := base64.StdEncoding.DecodeString(encoded)
-	if err != nil {
-		return nil, fmt.Errorf("decode key from %s: %w", keyFile, err)
+// defaultRetryBackoff is the delay before the first retry of a failed
+// daemon run
+const defaultRetryBackoff = time.Minute
+
+// Schedule builds the run schedule of the daemon. Cron takes precedence
+// over IntervalSecs, Window is a local time range like "02:00-04:00".
+func (d DaemonConfig) Schedule() (*schedule.Schedule, error) {
+	s := &schedule.Schedule{
+		Interval: time.Duration(d.IntervalSecs) * time.Second,
+		Jitter:   time.Duration(d.JitterSecs) * time.Second,
+
+		RetryAttempts: d.RetryMaxAttempts,
+		RetryBackoff:  time.Duration(d.RetryBackoffSecs) * time.Second,
+	}
+	if s.RetryBackoff <= 0 {
+		s.RetryBackoff = defaultRetryBackoff
 	}
 
-	if len(decoded) != 32 {
-		return nil, fmt.Errorf("key file %s: invalid size %d bytes (expected 32)", keyFile, len(decoded))
+	if d.Cron != "" {
+		c, err := schedule.ParseCron(d.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("daemon.cron: %w", err)
+		}
+		s.Cron = c
+	} else if d.IntervalSecs <= 0 {
+		return nil, fmt.Errorf("daemon.interval_secs must be positive")
 	}
 
-	return decoded, nil
+	if d.Window != "" {
+		w, err := schedule.ParseWindow(d.Window)
+		if err != nil {
+			return nil, fmt.Errorf("daemon.window: %w", err)
+		}
+		s.Window = w
+	}
+
+	return s, nil
+}
+
+// validate checks the schedule of an enabled daemon
+func (d DaemonConfig) validate() error {
+	if !d.Enabled {
+		return nil
+	}
+	_, err := d.Schedule()
+	return err
 }
 
-// GetOrCreateKey gets an existing key or creates a new one if it doesn't exist
-func GetOrCreateKey(keyDir, certName string) ([]byte, error) {
-	key, err := LoadKey(keyDir, certName)
-	if err == nil {
-		return key, nil
+// checkDirsOverlap returns an error if key_dir and cert_dir are the same
+// directory or one is inside the other, which would mix encryption keys
+// with certificates
+func checkDirsOverlap(keyDir, certDir string) error {
+	if keyDir == "" || certDir == "" {
+		return nil
 	}
 
-	// Key doesn't exist, create a new one
-	key, err = GenerateKey()
+	keyPath, err := resolveDir(keyDir)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	certPath, err := resolveDir(certDir)
+	if err != nil {
+		return err
 	}
 
-	if err := SaveKey(keyDir, certName, key); err != nil {
-		return nil, err
+	if isWithin(keyPath, certPath) || isWithin(certPath, keyPath) {
+		return fmt.Errorf("key_dir %s and cert_dir %s must not overlap", keyDir, certDir)
 	}
 
-	return key, nil
+	return nil
+}
+
+// resolveDir returns the absolute path of dir with symlinks resolved as
+// far as the directory exists
+func resolveDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", dir, err)
+	}
+
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+// isWithin reports whether path is dir or below it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
 }
@@ -15,11 +15,19 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
+	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSaveAndLoadKey(t *testing.T) {
@@ -32,13 +40,13 @@ func TestSaveAndLoadKey(t *testing.T) {
 		t.Fatalf("GenerateKey failed: %v", err)
 	}
 
-	err = SaveKey(tmpDir, certName, key)
+	err = SaveKey(tmpDir, certName, key, nil)
 	if err != nil {
 		t.Fatalf("SaveKey failed: %v", err)
 	}
 
 	// Verify file exists and has correct permissions
-	keyFile := filepath.Join(tmpDir, certName+".key")
+	keyFile := filepath.Join(tmpDir, certName+KeyFileExt)
 	info, err := os.Stat(keyFile)
 	if err != nil {
 		t.Fatalf("Key file not created: %v", err)
@@ -48,7 +56,7 @@ func TestSaveAndLoadKey(t *testing.T) {
 		t.Errorf("Expected file permissions 0600, got %o", info.Mode().Perm())
 	}
 
-	// Verify file is base64 encoded with newline
+	// Verify file is a header followed by base64 with newline
 	data, err := os.ReadFile(keyFile)
 	if err != nil {
 		t.Fatalf("Failed to read key file: %v", err)
@@ -58,7 +66,11 @@ func TestSaveAndLoadKey(t *testing.T) {
 		t.Error("Key file should end with newline")
 	}
 
-	encoded := strings.TrimSpace(string(data))
+	header, encoded, ok := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	if !ok || header != keyFileHeader {
+		t.Errorf("Key file should start with header, got %q", data)
+	}
+
 	decoded, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		t.Errorf("Key file should contain valid base64: %v", err)
@@ -69,7 +81,7 @@ func TestSaveAndLoadKey(t *testing.T) {
 	}
 
 	// Load the key back
-	loadedKey, err := LoadKey(tmpDir, certName)
+	loadedKey, err := LoadKey(tmpDir, certName, nil)
 	if err != nil {
 		t.Fatalf("LoadKey failed: %v", err)
 	}
@@ -77,6 +89,11 @@ func TestSaveAndLoadKey(t *testing.T) {
 	if string(loadedKey) != string(key) {
 		t.Error("Loaded key does not match saved key")
 	}
+
+	// The temporary file is renamed into place
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 1 {
+		t.Errorf("Expected only the key file, got %v", entries)
+	}
 }
 
 func TestGetOrCreateKey(t *testing.T) {
@@ -84,7 +101,7 @@ func TestGetOrCreateKey(t *testing.T) {
 	certName := "auto-cert"
 
 	// First call should create new key
-	key1, err := GetOrCreateKey(tmpDir, certName)
+	key1, err := GetOrCreateKey(tmpDir, certName, nil)
 	if err != nil {
 		t.Fatalf("GetOrCreateKey failed: %v", err)
 	}
@@ -94,7 +111,7 @@ func TestGetOrCreateKey(t *testing.T) {
 	}
 
 	// Second call should return existing key
-	key2, err := GetOrCreateKey(tmpDir, certName)
+	key2, err := GetOrCreateKey(tmpDir, certName, nil)
 	if err != nil {
 		t.Fatalf("GetOrCreateKey failed on second call: %v", err)
 	}
@@ -103,3 +120,275 @@ func TestGetOrCreateKey(t *testing.T) {
 		t.Error("GetOrCreateKey should return same key on subsequent calls")
 	}
 }
+
+func TestSaveAndLoadWrappedKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	certName := "wrapped-cert"
+	passphrase := []byte("s3cret")
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	if err := SaveKey(tmpDir, certName, key, passphrase); err != nil {
+		t.Fatalf("SaveKey failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, certName+KeyFileExt))
+	if err != nil {
+		t.Fatalf("Failed to read key file: %v", err)
+	}
+
+	if !strings.Contains(string(data), "\nargon2id-") {
+		t.Errorf("Key file should be wrapped, got %q", data)
+	}
+
+	// Loading without the passphrase must fail
+	if _, err := LoadKey(tmpDir, certName, nil); err == nil {
+		t.Error("LoadKey should fail without passphrase")
+	}
+
+	loadedKey, err := LoadKey(tmpDir, certName, passphrase)
+	if err != nil {
+		t.Fatalf("LoadKey failed: %v", err)
+	}
+
+	if string(loadedKey) != string(key) {
+		t.Error("Loaded key does not match saved key")
+	}
+
+	// A key that cannot be unwrapped must not be replaced
+	if _, err := GetOrCreateKey(tmpDir, certName, []byte("wrong")); err == nil {
+		t.Error("GetOrCreateKey should fail with wrong passphrase")
+	}
+
+	loadedKey, err = LoadKey(tmpDir, certName, passphrase)
+	if err != nil || string(loadedKey) != string(key) {
+		t.Error("Key file was modified by GetOrCreateKey with wrong passphrase")
+	}
+}
+
+func TestPassphraseLoad(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// No source configured
+	passphrase, err := PassphraseConfig{}.Load()
+	if err != nil || passphrase != nil {
+		t.Errorf("Expected nil passphrase, got %q, %v", passphrase, err)
+	}
+
+	passFile := filepath.Join(tmpDir, "passphrase")
+	if err := os.WriteFile(passFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Failed to write passphrase file: %v", err)
+	}
+
+	passphrase, err = PassphraseConfig{File: passFile}.Load()
+	if err != nil || string(passphrase) != "from-file" {
+		t.Errorf("Expected 'from-file', got %q, %v", passphrase, err)
+	}
+
+	t.Setenv("TEST_PASSPHRASE", "from-env")
+	passphrase, err = PassphraseConfig{Env: "TEST_PASSPHRASE"}.Load()
+	if err != nil || string(passphrase) != "from-env" {
+		t.Errorf("Expected 'from-env', got %q, %v", passphrase, err)
+	}
+
+	t.Setenv("CREDENTIALS_DIRECTORY", tmpDir)
+	passphrase, err = PassphraseConfig{Credential: "passphrase"}.Load()
+	if err != nil || string(passphrase) != "from-file" {
+		t.Errorf("Expected 'from-file', got %q, %v", passphrase, err)
+	}
+}
+
+func TestMigrateLegacyKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	certName := "legacy-cert"
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	// Legacy key files are bare base64 with a .key extension
+	legacyFile := filepath.Join(tmpDir, certName+".key")
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(legacyFile, []byte(encoded), 0600); err != nil {
+		t.Fatalf("Failed to write legacy key: %v", err)
+	}
+
+	names, err := ListKeys(tmpDir)
+	if err != nil || len(names) != 1 || names[0] != certName {
+		t.Errorf("ListKeys should include legacy keys, got %v, %v", names, err)
+	}
+
+	loadedKey, err := LoadKey(tmpDir, certName, nil)
+	if err != nil {
+		t.Fatalf("LoadKey failed: %v", err)
+	}
+
+	if string(loadedKey) != string(key) {
+		t.Error("Loaded key does not match legacy key")
+	}
+
+	if _, err := os.Stat(legacyFile); !os.IsNotExist(err) {
+		t.Error("Legacy key file should be removed after migration")
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, certName+KeyFileExt)); err != nil {
+		t.Errorf("Migrated key file not created: %v", err)
+	}
+}
+
+func TestKeyDirCertDirOverlap(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		keyDir, certDir string
+		overlap         bool
+	}{
+		{"keys", "certificates", false},
+		{"keys", "keys-backup", false},
+		{"shared", "shared", true},
+		{"shared", "shared/", true},
+		{"certs/keys", "certs", true},
+		{"keys", "keys/certs", true},
+	}
+
+	for _, tt := range tests {
+		configPath := filepath.Join(tmpDir, "pull.toml")
+		content := "key_dir = '" + filepath.Join(tmpDir, tt.keyDir) + "'\n" +
+			"cert_dir = '" + filepath.Join(tmpDir, tt.certDir) + "'\n"
+		if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		_, err := LoadPull(configPath)
+		if tt.overlap && err == nil {
+			t.Errorf("LoadPull should reject key_dir %s and cert_dir %s", tt.keyDir, tt.certDir)
+		}
+		if !tt.overlap && err != nil {
+			t.Errorf("LoadPull failed for key_dir %s and cert_dir %s: %v", tt.keyDir, tt.certDir, err)
+		}
+	}
+}
+
+func TestDaemonSchedule(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		daemon string
+		valid  bool
+	}{
+		{"enabled = true\ninterval_secs = 300\n", true},
+		{"enabled = true\ncron = '17 3,15 * * *'\nwindow = '02:00-04:00'\n", true},
+		{"enabled = true\n", false},
+		{"enabled = true\ncron = '17 3,15 * *'\n", false},
+		{"enabled = true\ninterval_secs = 300\nwindow = '02:00'\n", false},
+		// Only checked when the daemon is enabled
+		{"cron = 'invalid'\n", true},
+	}
+
+	for _, tt := range tests {
+		configPath := filepath.Join(tmpDir, "push.toml")
+		if err := os.WriteFile(configPath, []byte("[daemon]\n"+tt.daemon), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		_, err := LoadPush(configPath)
+		if tt.valid && err != nil {
+			t.Errorf("LoadPush failed for daemon config %q: %v", tt.daemon, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("LoadPush should reject daemon config %q", tt.daemon)
+		}
+	}
+}
+
+func TestStorages(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		config string
+		names  []string
+	}{
+		{"", []string{"s3"}},
+		{"[s3]\nbucket = 'certs'\n[[destinations]]\npath = '/srv/mirror'\n[[destinations]]\nname = 'minio'\ns3.bucket = 'certs'\n", []string{"s3", "/srv/mirror", "minio"}},
+		{"[[destinations]]\ns3.bucket = 'certs'\n", []string{"s3://certs"}},
+		// Exactly one of path and bucket
+		{"[[destinations]]\nname = 'empty'\n", nil},
+		{"[[destinations]]\npath = '/srv/mirror'\ns3.bucket = 'certs'\n", nil},
+		// Names must be unique
+		{"[s3]\nbucket = 'certs'\n[[destinations]]\nname = 's3'\npath = '/srv/mirror'\n", nil},
+	}
+
+	for _, tt := range tests {
+		configPath := filepath.Join(tmpDir, "push.toml")
+		if err := os.WriteFile(configPath, []byte(tt.config), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		cfg, err := LoadPush(configPath)
+		if tt.names == nil {
+			if err == nil {
+				t.Errorf("LoadPush should reject %q", tt.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LoadPush failed for %q: %v", tt.config, err)
+			continue
+		}
+
+		var names []string
+		for _, s := range cfg.Storages() {
+			names = append(names, s.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+			t.Errorf("Storages of %q = %v, want %v", tt.config, names, tt.names)
+		}
+	}
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	tmpDir := t.TempDir()
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second).UTC()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	files := map[string][]byte{
+		"example.com.crt":        certPEM,
+		"example.com.issuer.crt": certPEM,
+		"example.com.key":        []byte("not a certificate"),
+		"broken.crt":             []byte("not a certificate"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	expiry, err := CertificateExpiry(tmpDir)
+	if err != nil {
+		t.Fatalf("CertificateExpiry failed: %v", err)
+	}
+
+	if len(expiry) != 1 || !expiry["example.com"].Equal(notAfter) {
+		t.Errorf("Expected only example.com expiring at %v, got %v", notAfter, expiry)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/atomicfile"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/crypto"
+)
+
+// KeyFileExt is the extension of encryption key files. It is distinct
+// from .key so keys can never be confused with certificate private keys.
+const KeyFileExt = ".pushpuller-key"
+
+// legacyKeyFileExt is the extension used by older versions
+const legacyKeyFileExt = ".key"
+
+// keyFileHeader is the first line of every key file
+const keyFileHeader = "# digilol-cert-pushpuller encryption key"
+
+// GenerateKey generates a random 32-byte key for encryption
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate random key: %w", err)
+	}
+	return key, nil
+}
+
+// SaveKey saves the encryption key to a key file as base64 below a header
+// line. If passphrase is non-empty the key is wrapped with it before writing.
+func SaveKey(keyDir, certName string, key, passphrase []byte) error {
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return fmt.Errorf("create key directory: %w", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(key)
+	if len(passphrase) > 0 {
+		wrapped, err := crypto.WrapKey(key, passphrase)
+		if err != nil {
+			return fmt.Errorf("wrap key for %s: %w", certName, err)
+		}
+		encoded = wrapped
+	}
+
+	// Write to a temporary file first so rewrapping never leaves a
+	// truncated key behind
+	keyFile := filepath.Join(keyDir, certName+KeyFileExt)
+	content := keyFileHeader + "\n" + encoded + "\n"
+	err := atomicfile.Write(keyFile, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write key file %s: %w", keyFile, err)
+	}
+
+	return nil
+}
+
+// LoadKey loads the encryption key from a key file (base64 encoded or
+// wrapped with a passphrase). Key files using the legacy .key extension
+// are migrated to the current format on first use.
+func LoadKey(keyDir, certName string, passphrase []byte) ([]byte, error) {
+	keyFile := filepath.Join(keyDir, certName+KeyFileExt)
+	data, err := os.ReadFile(keyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return migrateKey(keyDir, certName, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read key file %s: %w", keyFile, err)
+	}
+
+	return decodeKey(keyFile, data, passphrase)
+}
+
+// migrateKey converts a legacy <cert>.key file into the current format
+func migrateKey(keyDir, certName string, passphrase []byte) ([]byte, error) {
+	legacyFile := filepath.Join(keyDir, certName+legacyKeyFileExt)
+	data, err := os.ReadFile(legacyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key file %s: %w", filepath.Join(keyDir, certName+KeyFileExt), err)
+	}
+
+	key, err := decodeKey(legacyFile, data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the key wrapped if it was wrapped before
+	var target []byte
+	if crypto.IsWrappedKey(strings.TrimSpace(string(data))) {
+		target = passphrase
+	}
+
+	if err := SaveKey(keyDir, certName, key, target); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(legacyFile); err != nil {
+		return nil, fmt.Errorf("remove migrated key file %s: %w", legacyFile, err)
+	}
+
+	return key, nil
+}
+
+// decodeKey parses the contents of a key file
+func decodeKey(keyFile string, data []byte, passphrase []byte) ([]byte, error) {
+	// Skip the header and trim whitespace (including newline)
+	encoded := strings.TrimSpace(strings.TrimPrefix(string(data), keyFileHeader))
+
+	var decoded []byte
+	var err error
+	if crypto.IsWrappedKey(encoded) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("key file %s is wrapped but no passphrase is configured", keyFile)
+		}
+		decoded, err = crypto.UnwrapKey(encoded, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap key from %s: %w", keyFile, err)
+		}
+	} else {
+		decoded, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode key from %s: %w", keyFile, err)
+		}
+	}
+
+	if len(decoded) != 32 {
+		return nil, fmt.Errorf("key file %s: invalid size %d bytes (expected 32)", keyFile, len(decoded))
+	}
+
+	return decoded, nil
+}
+
+// ListKeys returns the certificate names of all keys in keyDir, including
+// keys that still use the legacy extension
+func ListKeys(keyDir string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, ext := range []string{KeyFileExt, legacyKeyFileExt} {
+		keyFiles, err := filepath.Glob(filepath.Join(keyDir, "*"+ext))
+		if err != nil {
+			return nil, fmt.Errorf("list key files: %w", err)
+		}
+
+		for _, keyFile := range keyFiles {
+			name := strings.TrimSuffix(filepath.Base(keyFile), ext)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// GetOrCreateKey gets an existing key or creates a new one if it doesn't exist
+func GetOrCreateKey(keyDir, certName string, passphrase []byte) ([]byte, error) {
+	key, err := LoadKey(keyDir, certName, passphrase)
+	if err == nil {
+		return key, nil
+	}
+
+	// Only create a new key if there is none; a key that fails to load
+	// (e.g. wrong passphrase) must never be overwritten
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// Key doesn't exist, create a new one
+	key, err = GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SaveKey(keyDir, certName, key, passphrase); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
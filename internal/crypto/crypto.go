@@ -22,14 +22,48 @@ import (
 	"github.com/minio/sio"
 )
 
+// sioConfig returns the sio configuration used for all objects
+func sioConfig(key []byte) sio.Config {
+	return sio.Config{
+		MinVersion: sio.Version20,
+		Key:        key,
+	}
+}
+
+// EncryptReader returns a reader that yields the encryption of src
+func EncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	encReader, err := sio.EncryptReader(src, sioConfig(key))
+	if err != nil {
+		return nil, fmt.Errorf("create encryption reader: %w", err)
+	}
+	return encReader, nil
+}
+
+// EncryptedSize returns the size of size bytes of plaintext once encrypted
+func EncryptedSize(size int64) (int64, error) {
+	encSize, err := sio.EncryptedSize(uint64(size))
+	if err != nil {
+		return 0, fmt.Errorf("compute encrypted size: %w", err)
+	}
+	return int64(encSize), nil
+}
+
+// DecryptStream decrypts src into dst and returns the number of plaintext
+// bytes written. Data is authenticated package by package, so on error dst
+// may already hold a prefix of the plaintext and must be discarded.
+func DecryptStream(dst io.Writer, src io.Reader, key []byte) (int64, error) {
+	n, err := sio.Decrypt(dst, src, sioConfig(key))
+	if err != nil {
+		return n, fmt.Errorf("decrypt data: %w", err)
+	}
+	return n, nil
+}
+
 // EncryptData encrypts data using the provided key
 func EncryptData(data []byte, key []byte) ([]byte, error) {
 	var buf bytes.Buffer
 
-	config := sio.Config{
-		MinVersion: sio.Version20,
-		Key:        key,
-	}
+	config := sioConfig(key)
 
 	encWriter, err := sio.EncryptWriter(&buf, config)
 	if err != nil {
@@ -49,10 +83,7 @@ func EncryptData(data []byte, key []byte) ([]byte, error) {
 
 // DecryptData decrypts data using the provided key
 func DecryptData(encryptedData []byte, key []byte) ([]byte, error) {
-	config := sio.Config{
-		MinVersion: sio.Version20,
-		Key:        key,
-	}
+	config := sioConfig(key)
 
 	decReader, err := sio.DecryptReader(bytes.NewReader(encryptedData), config)
 	if err != nil {
@@ -79,3 +79,85 @@ func TestDecryptWithWrongKey(t *testing.T) {
 		t.Error("DecryptData should fail with wrong key")
 	}
 }
+
+func TestWrapUnwrapKey(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	wrapped, err := WrapKey(key, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("WrapKey failed: %v", err)
+	}
+
+	if !IsWrappedKey(wrapped) {
+		t.Errorf("Wrapped key should start with %q", WrappedKeyPrefix)
+	}
+
+	unwrapped, err := UnwrapKey(wrapped, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("UnwrapKey failed: %v", err)
+	}
+
+	if !bytes.Equal(unwrapped, key) {
+		t.Error("Unwrapped key doesn't match original")
+	}
+
+	// Wrong passphrase must be rejected
+	if _, err := UnwrapKey(wrapped, []byte("battery staple")); err != ErrWrongPassphrase {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// Larger than one sio package to exercise streaming
+	testData := make([]byte, 200*1024+17)
+	if _, err := rand.Read(testData); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+
+	encReader, err := EncryptReader(bytes.NewReader(testData), key)
+	if err != nil {
+		t.Fatalf("EncryptReader failed: %v", err)
+	}
+
+	var encrypted bytes.Buffer
+	if _, err := encrypted.ReadFrom(encReader); err != nil {
+		t.Fatalf("Reading encrypted stream failed: %v", err)
+	}
+
+	encSize, err := EncryptedSize(int64(len(testData)))
+	if err != nil {
+		t.Fatalf("EncryptedSize failed: %v", err)
+	}
+
+	if int64(encrypted.Len()) != encSize {
+		t.Errorf("Expected encrypted size %d, got %d", encSize, encrypted.Len())
+	}
+
+	// Streams are compatible with the buffered API
+	decrypted, err := DecryptData(encrypted.Bytes(), key)
+	if err != nil {
+		t.Fatalf("DecryptData failed: %v", err)
+	}
+
+	if !bytes.Equal(decrypted, testData) {
+		t.Error("Decrypted data doesn't match original")
+	}
+
+	var out bytes.Buffer
+	n, err := DecryptStream(&out, bytes.NewReader(encrypted.Bytes()), key)
+	if err != nil {
+		t.Fatalf("DecryptStream failed: %v", err)
+	}
+
+	if n != int64(len(testData)) || !bytes.Equal(out.Bytes(), testData) {
+		t.Error("Decrypted stream doesn't match original")
+	}
+}
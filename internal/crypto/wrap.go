@@ -0,0 +1,110 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// WrappedKeyPrefix marks a key that has been wrapped with a passphrase
+const WrappedKeyPrefix = "argon2id-xchacha20poly1305:"
+
+// Argon2id parameters used to derive the key encryption key
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	saltSize     = 16
+)
+
+// ErrWrongPassphrase is returned when a wrapped key cannot be opened
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted wrapped key")
+
+// IsWrappedKey reports whether data holds a passphrase-wrapped key
+func IsWrappedKey(data string) bool {
+	return strings.HasPrefix(data, WrappedKeyPrefix)
+}
+
+// WrapKey encrypts key with a key derived from passphrase using Argon2id
+// and returns it in the textual wrapped key format. The key may be any
+// byte string, which is also used to encrypt enrollment bundles.
+func WrapKey(key, passphrase []byte) (string, error) {
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("empty passphrase")
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate salt: %w", err)
+	}
+
+	aead, err := chacha20poly1305.NewX(deriveKEK(passphrase, salt))
+	if err != nil {
+		return "", fmt.Errorf("create cipher: %w", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+
+	out := append(salt, nonce...)
+	out = aead.Seal(out, nonce, key, []byte(WrappedKeyPrefix))
+
+	return WrappedKeyPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// UnwrapKey decrypts a key produced by WrapKey
+func UnwrapKey(wrapped string, passphrase []byte) ([]byte, error) {
+	if !IsWrappedKey(wrapped) {
+		return nil, fmt.Errorf("not a wrapped key")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(wrapped, WrappedKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decode wrapped key: %w", err)
+	}
+
+	if len(raw) < saltSize+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+
+	salt := raw[:saltSize]
+	nonce := raw[saltSize : saltSize+chacha20poly1305.NonceSizeX]
+	ciphertext := raw[saltSize+chacha20poly1305.NonceSizeX:]
+
+	aead, err := chacha20poly1305.NewX(deriveKEK(passphrase, salt))
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+
+	key, err := aead.Open(nil, nonce, ciphertext, []byte(WrappedKeyPrefix))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return key, nil
+}
+
+func deriveKEK(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, argonTime, argonMemory, argonThreads, chacha20poly1305.KeySize)
+}
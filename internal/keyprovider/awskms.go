@@ -0,0 +1,116 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/smithy-go"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+// noKeyErrorCodes are the KMS errors meaning this client may not decrypt a
+// certificate, e.g. because a key policy or grant doesn't allow it. A
+// disabled key or expired credentials are failures instead.
+var noKeyErrorCodes = map[string]bool{
+	"AccessDeniedException": true,
+}
+
+// AWSKMS wraps data keys with an AWS KMS key. The certificate name is
+// bound to each data key through the encryption context, so IAM policies
+// can restrict which certificates a client may decrypt.
+type AWSKMS struct {
+	keyID  string
+	client *kms.Client
+}
+
+// NewAWSKMS creates an AWS KMS provider. If no static credentials are
+// configured the default AWS credential chain is used.
+func NewAWSKMS(ctx context.Context, cfg *config.AWSKMSConfig) (*AWSKMS, error) {
+	if cfg.KeyID == "" {
+		return nil, fmt.Errorf("awskms key_id is not configured")
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(cfg.Region),
+	}
+	if cfg.AccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			cfg.AccessKey,
+			cfg.SecretKey,
+			"",
+		)))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load KMS config: %w", err)
+	}
+
+	client := kms.NewFromConfig(awsCfg, func(o *kms.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+
+	return &AWSKMS{keyID: cfg.KeyID, client: client}, nil
+}
+
+// GenerateDataKey asks KMS for a new AES-256 data key
+func (k *AWSKMS) GenerateDataKey(ctx context.Context, certName string) ([]byte, []byte, error) {
+	output, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             &k.keyID,
+		KeySpec:           types.DataKeySpecAes256,
+		EncryptionContext: encryptionContext(certName),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate data key for %s: %w", certName, err)
+	}
+
+	return output.Plaintext, output.CiphertextBlob, nil
+}
+
+// DecryptDataKey asks KMS to unwrap a data key
+func (k *AWSKMS) DecryptDataKey(ctx context.Context, certName string, wrapped []byte) ([]byte, error) {
+	if wrapped == nil {
+		return nil, fmt.Errorf("object key for %s is missing", certName)
+	}
+
+	output, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:             &k.keyID,
+		CiphertextBlob:    wrapped,
+		EncryptionContext: encryptionContext(certName),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && noKeyErrorCodes[apiErr.ErrorCode()] {
+		return nil, fmt.Errorf("decrypt data key for %s: %w: %w", certName, ErrNoKey, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key for %s: %w", certName, err)
+	}
+
+	return output.Plaintext, nil
+}
+
+func encryptionContext(certName string) map[string]string {
+	return map[string]string{"certificate": certName}
+}
@@ -0,0 +1,137 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+// fakeKMS fails every Decrypt call with the error code given as the
+// certificate name in the encryption context
+func fakeKMS(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "TrentService.Decrypt" {
+			t.Errorf("Unexpected request %s", target)
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		var req struct {
+			EncryptionContext map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  req.EncryptionContext["certificate"],
+			"message": "test error",
+		})
+	}))
+}
+
+func TestAWSKMSErrors(t *testing.T) {
+	ctx := context.Background()
+	server := fakeKMS(t)
+	defer server.Close()
+
+	provider, err := NewAWSKMS(ctx, &config.AWSKMSConfig{
+		KeyID:     "alias/certs",
+		Region:    "us-east-1",
+		Endpoint:  server.URL,
+		AccessKey: "test",
+		SecretKey: "test",
+	})
+	if err != nil {
+		t.Fatalf("NewAWSKMS failed: %v", err)
+	}
+
+	for code, noKey := range map[string]bool{
+		"AccessDeniedException":      true,
+		"KMSInvalidStateException":   false,
+		"InvalidCiphertextException": false,
+	} {
+		_, err := provider.DecryptDataKey(ctx, code, []byte("wrapped"))
+		if err == nil || errors.Is(err, ErrNoKey) != noKey {
+			t.Errorf("%s: expected ErrNoKey %v, got %v", code, noKey, err)
+		}
+	}
+}
+
+// TestAWSKMSLocalStack runs against a KMS compatible endpoint such as
+// LocalStack given in KMS_TEST_ENDPOINT
+func TestAWSKMSLocalStack(t *testing.T) {
+	endpoint := os.Getenv("KMS_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("KMS_TEST_ENDPOINT is not set")
+	}
+
+	ctx := context.Background()
+	provider, err := NewAWSKMS(ctx, &config.AWSKMSConfig{
+		KeyID:     "pending",
+		Region:    "us-east-1",
+		Endpoint:  endpoint,
+		AccessKey: "test",
+		SecretKey: "test",
+	})
+	if err != nil {
+		t.Fatalf("NewAWSKMS failed: %v", err)
+	}
+
+	// Use a throwaway key
+	created, err := provider.client.CreateKey(ctx, &kms.CreateKeyInput{})
+	if err != nil {
+		t.Fatalf("CreateKey failed: %v", err)
+	}
+	provider.keyID = *created.KeyMetadata.KeyId
+
+	key, wrapped, err := provider.GenerateDataKey(ctx, "kms-cert")
+	if err != nil {
+		t.Fatalf("GenerateDataKey failed: %v", err)
+	}
+
+	decrypted, err := provider.DecryptDataKey(ctx, "kms-cert", wrapped)
+	if err != nil {
+		t.Fatalf("DecryptDataKey failed: %v", err)
+	}
+	if !bytes.Equal(key, decrypted) {
+		t.Error("Decrypted data key doesn't match generated key")
+	}
+
+	// The encryption context binds the data key to its certificate
+	if _, err := provider.DecryptDataKey(ctx, "other-cert", wrapped); err == nil {
+		t.Error("DecryptDataKey should fail for another certificate")
+	}
+
+	// Keys pending deletion can't be used, which is a failure rather than
+	// a certificate the client may not decrypt
+	days := int32(7)
+	if _, err := provider.client.ScheduleKeyDeletion(ctx, &kms.ScheduleKeyDeletionInput{KeyId: &provider.keyID, PendingWindowInDays: &days}); err != nil {
+		t.Fatalf("ScheduleKeyDeletion failed: %v", err)
+	}
+	if _, err := provider.DecryptDataKey(ctx, "kms-cert", wrapped); err == nil || errors.Is(err, ErrNoKey) {
+		t.Errorf("Expected failure for a key pending deletion, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+// ErrNoKey is returned when the provider has no key for a certificate.
+// Pull treats it as "this client may not decrypt the certificate".
+var ErrNoKey = errors.New("no key for certificate")
+
+// KeyProvider hands out the data keys used to encrypt individual objects.
+//
+// Providers that protect data keys with a root key held elsewhere return
+// the wrapped form of each data key, which is stored next to the object.
+// Providers that need nothing stored return a nil wrapped key.
+type KeyProvider interface {
+	// GenerateDataKey returns a key for encrypting an object of certName
+	// and its wrapped form
+	GenerateDataKey(ctx context.Context, certName string) (plaintext, wrapped []byte, err error)
+
+	// DecryptDataKey returns the key for an object of certName given the
+	// wrapped key stored next to it (nil if there was none)
+	DecryptDataKey(ctx context.Context, certName string, wrapped []byte) ([]byte, error)
+}
+
+// New creates the key provider selected in cfg
+func New(ctx context.Context, cfg *config.KeyProviderConfig, keyDir string, passphrase []byte) (KeyProvider, error) {
+	switch cfg.Type {
+	case "", "local":
+		return NewLocal(keyDir, passphrase), nil
+	case "vault":
+		return NewVault(&cfg.Vault)
+	case "awskms":
+		return NewAWSKMS(ctx, &cfg.AWSKMS)
+	default:
+		return nil, fmt.Errorf("unknown key provider type %q", cfg.Type)
+	}
+}
+
+// Local uses the per-certificate key files in a key directory directly
+// as data keys, so nothing is stored next to the objects
+type Local struct {
+	keyDir     string
+	passphrase []byte
+}
+
+// NewLocal creates a provider backed by key files in keyDir
+func NewLocal(keyDir string, passphrase []byte) *Local {
+	return &Local{keyDir: keyDir, passphrase: passphrase}
+}
+
+// GenerateDataKey returns the certificate key, creating it if needed
+func (l *Local) GenerateDataKey(ctx context.Context, certName string) ([]byte, []byte, error) {
+	key, err := config.GetOrCreateKey(l.keyDir, certName, l.passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, nil, nil
+}
+
+// DecryptDataKey returns the certificate key. Objects carrying a wrapped
+// key were written with another provider and are rejected.
+func (l *Local) DecryptDataKey(ctx context.Context, certName string, wrapped []byte) ([]byte, error) {
+	if wrapped != nil {
+		return nil, fmt.Errorf("object key for %s is wrapped by a different key provider", certName)
+	}
+
+	key, err := config.LoadKey(l.keyDir, certName, l.passphrase)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoKey
+	}
+	return key, err
+}
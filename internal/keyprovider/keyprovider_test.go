@@ -0,0 +1,135 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+func TestLocalProvider(t *testing.T) {
+	ctx := context.Background()
+	provider := NewLocal(t.TempDir(), nil)
+
+	// Unknown certificates have no key
+	if _, err := provider.DecryptDataKey(ctx, "missing", nil); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Expected ErrNoKey, got %v", err)
+	}
+
+	key, wrapped, err := provider.GenerateDataKey(ctx, "local-cert")
+	if err != nil {
+		t.Fatalf("GenerateDataKey failed: %v", err)
+	}
+
+	if wrapped != nil {
+		t.Error("Local provider should not return a wrapped key")
+	}
+
+	decrypted, err := provider.DecryptDataKey(ctx, "local-cert", nil)
+	if err != nil {
+		t.Fatalf("DecryptDataKey failed: %v", err)
+	}
+
+	if !bytes.Equal(key, decrypted) {
+		t.Error("DecryptDataKey should return the certificate key")
+	}
+
+	// Objects wrapped by another provider cannot be opened
+	if _, err := provider.DecryptDataKey(ctx, "local-cert", []byte("vault:v1:abc")); err == nil {
+		t.Error("DecryptDataKey should reject wrapped keys")
+	}
+}
+
+// fakeTransit implements the datakey and decrypt endpoints of Vault
+// Transit by "wrapping" keys with a fixed prefix
+func fakeTransit(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		var data map[string]string
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/certs":
+			plaintext := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+			data = map[string]string{"plaintext": plaintext, "ciphertext": "vault:v1:" + plaintext}
+		case "/v1/transit/decrypt/certs":
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			data = map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")}
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+}
+
+func TestVaultProvider(t *testing.T) {
+	ctx := context.Background()
+	server := fakeTransit(t)
+	defer server.Close()
+
+	provider, err := NewVault(&config.VaultConfig{
+		Address: server.URL,
+		Token:   "test-token",
+		KeyName: "certs",
+	})
+	if err != nil {
+		t.Fatalf("NewVault failed: %v", err)
+	}
+
+	key, wrapped, err := provider.GenerateDataKey(ctx, "vault-cert")
+	if err != nil {
+		t.Fatalf("GenerateDataKey failed: %v", err)
+	}
+
+	if len(key) != 32 || !strings.HasPrefix(string(wrapped), "vault:v1:") {
+		t.Errorf("Unexpected data key %x / %q", key, wrapped)
+	}
+
+	decrypted, err := provider.DecryptDataKey(ctx, "vault-cert", wrapped)
+	if err != nil {
+		t.Fatalf("DecryptDataKey failed: %v", err)
+	}
+
+	if !bytes.Equal(key, decrypted) {
+		t.Error("Decrypted data key doesn't match generated key")
+	}
+
+	// Vault errors are surfaced
+	provider.token = "wrong"
+	if _, _, err := provider.GenerateDataKey(ctx, "vault-cert"); err == nil || errors.Is(err, ErrNoKey) || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected permission denied error, got %v", err)
+	}
+
+	// A bad or expired token is a failure, not a missing key
+	if _, err := provider.DecryptDataKey(ctx, "vault-cert", wrapped); err == nil || errors.Is(err, ErrNoKey) || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected permission denied error, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+// Vault wraps data keys with a HashiCorp Vault Transit key
+type Vault struct {
+	address string
+	token   string
+	mount   string
+	keyName string
+	client  *http.Client
+}
+
+// NewVault creates a Vault Transit provider. Address and token fall back
+// to the VAULT_ADDR and VAULT_TOKEN environment variables.
+func NewVault(cfg *config.VaultConfig) (*Vault, error) {
+	v := &Vault{
+		address: cfg.Address,
+		token:   cfg.Token,
+		mount:   cfg.Mount,
+		keyName: cfg.KeyName,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if v.address == "" {
+		v.address = os.Getenv("VAULT_ADDR")
+	}
+	if v.token == "" {
+		v.token = os.Getenv("VAULT_TOKEN")
+	}
+	if v.mount == "" {
+		v.mount = "transit"
+	}
+
+	if v.address == "" {
+		return nil, fmt.Errorf("vault address is not configured")
+	}
+	if v.keyName == "" {
+		return nil, fmt.Errorf("vault key_name is not configured")
+	}
+
+	v.address = strings.TrimSuffix(v.address, "/")
+	return v, nil
+}
+
+// GenerateDataKey asks Transit for a new 256-bit data key
+func (v *Vault) GenerateDataKey(ctx context.Context, certName string) ([]byte, []byte, error) {
+	var resp struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := v.call(ctx, "datakey/plaintext", map[string]any{"bits": 256}, &resp); err != nil {
+		return nil, nil, fmt.Errorf("generate data key for %s: %w", certName, err)
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode data key for %s: %w", certName, err)
+	}
+
+	return plaintext, []byte(resp.Ciphertext), nil
+}
+
+// DecryptDataKey asks Transit to unwrap a data key
+func (v *Vault) DecryptDataKey(ctx context.Context, certName string, wrapped []byte) ([]byte, error) {
+	if wrapped == nil {
+		return nil, fmt.Errorf("object key for %s is missing", certName)
+	}
+
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call(ctx, "decrypt", map[string]any{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, fmt.Errorf("decrypt data key for %s: %w", certName, err)
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decode data key for %s: %w", certName, err)
+	}
+
+	return plaintext, nil
+}
+
+// call posts body to a Transit endpoint and decodes the data field of the
+// response into out
+func (v *Vault) call(ctx context.Context, endpoint string, body any, out any) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", v.address, v.mount, endpoint, v.keyName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(respBody, &vaultErr)
+		if len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &envelope); err != nil {
+		return fmt.Errorf("parse vault response: %w", err)
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return fmt.Errorf("parse vault response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+const (
+	// FileName is the name of the manifest below the S3 prefix
+	FileName = ".manifest.json"
+
+	// LegacyFileName is the name of the manifest of older versions, which
+	// only mapped file names to hashes with objects stored at <file>.enc
+	LegacyFileName = ".hashes.json"
+
+	// Version is the current manifest format
+	Version = 1
+
+	// objectDir holds the objects of all generations below the S3 prefix
+	objectDir = "objects/"
+)
+
+// Entry describes the published generation of one certificate file
+type Entry struct {
+	// SHA256 is the hex encoded hash of the unencrypted file
+	SHA256 string `json:"sha256"`
+
+	// Object is the key of the encrypted file relative to the S3 prefix
+	Object string `json:"object"`
+
+	// DEK is set if the wrapped data key is stored at Object + ".dek"
+	DEK bool `json:"dek,omitempty"`
+
+	// Owner is the ID of the pusher that publishes the file. Only the owner
+	// updates or removes the entry.
+	Owner string `json:"owner,omitempty"`
+}
+
+// OwnedBy reports whether the pusher with the given ID may update or
+// remove the entry
+func (e Entry) OwnedBy(owner string) bool {
+	return e.Owner == owner
+}
+
+// Claimable reports whether the pusher with the given ID may take over the
+// entry, which is the case for its own entries and entries without owner
+func (e Entry) Claimable(owner string) bool {
+	return e.Owner == owner || e.Owner == ""
+}
+
+// Manifest lists the published generation of every certificate file.
+// Objects are never overwritten while referenced, so replacing the
+// manifest is the single step that publishes new certificates.
+type Manifest struct {
+	Version int              `json:"version"`
+	Files   map[string]Entry `json:"files"`
+}
+
+// New returns an empty manifest
+func New() *Manifest {
+	return &Manifest{Version: Version, Files: make(map[string]Entry)}
+}
+
+// NewObjectKey returns a unique object key, relative to the S3 prefix, for
+// a new generation of fileName with the given hash. Pushers uploading the
+// same file concurrently never write to the same object.
+func NewObjectKey(fileName, hash string) string {
+	return objectDir + fileName + "/" + hash + "-" + rand.Text() + ".enc"
+}
+
+// ObjectFileName returns the certificate file name an object key relative
+// to the S3 prefix belongs to, for both generation and legacy objects.
+// Wrapped data keys belong to the file of their object. Keys that don't
+// name a certificate or key file don't match, so objects of other
+// applications sharing the prefix are left alone.
+func ObjectFileName(key string) (string, bool) {
+	key = strings.TrimSuffix(key, ".dek")
+	if !strings.HasSuffix(key, ".enc") {
+		return "", false
+	}
+
+	var fileName string
+	if rest, ok := strings.CutPrefix(key, objectDir); ok {
+		fileName, _, _ = strings.Cut(rest, "/")
+	} else {
+		// Legacy objects live directly below the prefix
+		fileName = strings.TrimSuffix(key, ".enc")
+	}
+
+	if ValidFileName(fileName) != nil {
+		return "", false
+	}
+	if _, ok := config.ExtractCertName(fileName); !ok {
+		return "", false
+	}
+	return fileName, true
+}
+
+// Parse decodes a manifest
+func Parse(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]Entry)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ValidFileName checks that a certificate file name is a plain file name,
+// so it can't escape the directories it is joined with
+func ValidFileName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "..") || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// Validate checks the file names of all entries and that their objects
+// use the generation or the legacy layout of the file
+func (m *Manifest) Validate() error {
+	for fileName, e := range m.Files {
+		if err := ValidFileName(fileName); err != nil {
+			return err
+		}
+		if !validObject(fileName, e.Object) {
+			return fmt.Errorf("invalid object %q for %s", e.Object, fileName)
+		}
+	}
+	return nil
+}
+
+// validObject reports whether key is a generation object of fileName or
+// its legacy object
+func validObject(fileName, key string) bool {
+	if key == fileName+".enc" {
+		return true
+	}
+
+	name, ok := strings.CutPrefix(key, objectDir+fileName+"/")
+	if !ok || ValidFileName(name) != nil {
+		return false
+	}
+	return strings.HasSuffix(name, ".enc")
+}
+
+// FromLegacy converts the hashes of a legacy manifest. objects is the set
+// of object keys relative to the S3 prefix, used to find wrapped data keys.
+func FromLegacy(hashes map[string]string, objects map[string]bool) *Manifest {
+	m := New()
+	m.Version = 0
+	for fileName, hash := range hashes {
+		object := fileName + ".enc"
+		m.Files[fileName] = Entry{
+			SHA256: hash,
+			Object: object,
+			DEK:    objects[object+".dek"],
+		}
+	}
+	return m
+}
+
+// Marshal encodes the manifest
+func (m *Manifest) Marshal() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("marshal manifest: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// Equal reports whether both manifests have the same version and entries
+func (m *Manifest) Equal(other *Manifest) bool {
+	return m.Version == other.Version && maps.Equal(m.Files, other.Files)
+}
+
+// Referenced returns the set of object keys relative to the S3 prefix,
+// including wrapped data keys, that the manifest refers to
+func (m *Manifest) Referenced() map[string]bool {
+	refs := make(map[string]bool, 2*len(m.Files))
+	for _, e := range m.Files {
+		refs[e.Object] = true
+		refs[e.Object+".dek"] = true
+	}
+	return refs
+}
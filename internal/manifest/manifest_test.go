@@ -0,0 +1,134 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import "testing"
+
+func TestRoundTrip(t *testing.T) {
+	m := New()
+	m.Files["a.example.com.crt"] = Entry{SHA256: "abc", Object: NewObjectKey("a.example.com.crt", "abc"), DEK: true}
+
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !parsed.Equal(m) {
+		t.Errorf("parsed manifest %+v differs from %+v", parsed, m)
+	}
+
+	if _, err := Parse([]byte(`{"version":2,"files":{}}`)); err == nil {
+		t.Error("Parse should reject unknown versions")
+	}
+	if _, err := Parse([]byte(`{"a.example.com.crt":"abc"}`)); err == nil {
+		t.Error("Parse should reject legacy manifests")
+	}
+}
+
+func TestParseRejectsUnsafeNames(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		manifest string
+	}{
+		{"parent directory", `{"version":1,"files":{"../../etc/x.crt":{"object":"../../etc/x.crt.enc"}}}`},
+		{"subdirectory", `{"version":1,"files":{"a/x.crt":{"object":"a/x.crt.enc"}}}`},
+		{"backslash", `{"version":1,"files":{"..\\x.crt":{"object":"..\\x.crt.enc"}}}`},
+		{"hidden file", `{"version":1,"files":{".x.crt":{"object":".x.crt.enc"}}}`},
+		{"empty name", `{"version":1,"files":{"":{"object":".enc"}}}`},
+		{"object of other file", `{"version":1,"files":{"x.crt":{"object":"objects/y.crt/abc.enc"}}}`},
+		{"object outside prefix", `{"version":1,"files":{"x.crt":{"object":"objects/x.crt/../../../abc.enc"}}}`},
+		{"nested object", `{"version":1,"files":{"x.crt":{"object":"objects/x.crt/a/abc.enc"}}}`},
+		{"object without suffix", `{"version":1,"files":{"x.crt":{"object":"objects/x.crt/abc"}}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tc.manifest)); err == nil {
+				t.Errorf("Parse accepted %s", tc.manifest)
+			}
+		})
+	}
+
+	valid := `{"version":1,"files":{"x.crt":{"object":"objects/x.crt/abc-DEF.enc"},"y.crt":{"object":"y.crt.enc"}}}`
+	if _, err := Parse([]byte(valid)); err != nil {
+		t.Errorf("Parse rejected valid manifest: %v", err)
+	}
+}
+
+func TestFromLegacy(t *testing.T) {
+	m := FromLegacy(
+		map[string]string{"a.example.com.crt": "abc", "b.example.com.crt": "def"},
+		map[string]bool{"a.example.com.crt.enc": true, "a.example.com.crt.enc.dek": true, "b.example.com.crt.enc": true},
+	)
+
+	if m.Version == Version {
+		t.Error("legacy manifest should not have the current version")
+	}
+	if e := m.Files["a.example.com.crt"]; e.Object != "a.example.com.crt.enc" || !e.DEK || e.SHA256 != "abc" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := m.Files["b.example.com.crt"]; e.DEK {
+		t.Errorf("entry without data key has DEK set: %+v", e)
+	}
+}
+
+func TestObjectFileName(t *testing.T) {
+	tests := map[string]string{
+		NewObjectKey("a.example.com.crt", "abc"):          "a.example.com.crt",
+		NewObjectKey("a.example.com.crt", "abc") + ".dek": "a.example.com.crt",
+		"a.example.com.key.enc":                           "a.example.com.key",
+		"a.example.com.key.enc.dek":                       "a.example.com.key",
+	}
+	for key, want := range tests {
+		if got, ok := ObjectFileName(key); !ok || got != want {
+			t.Errorf("ObjectFileName(%q) = %q, %v, want %q", key, got, ok, want)
+		}
+	}
+
+	if NewObjectKey("a.example.com.crt", "abc") == NewObjectKey("a.example.com.crt", "abc") {
+		t.Error("NewObjectKey returned the same key twice")
+	}
+
+	for _, key := range []string{FileName, LegacyFileName, ".orphans.json", "other/a.example.com.crt.enc", "objects/a.enc", "backup.enc", "a.example.com.issuer.crt.enc", "objects/backup/abc.enc", ".a.example.com.crt.enc"} {
+		if got, ok := ObjectFileName(key); ok {
+			t.Errorf("ObjectFileName(%q) = %q, want no match", key, got)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	tests := []struct {
+		owner, pusher      string
+		ownedBy, claimable bool
+	}{
+		{"", "", true, true},
+		{"", "dns-a", false, true},
+		{"dns-a", "dns-a", true, true},
+		{"dns-a", "dns-b", false, false},
+		{"dns-a", "", false, false},
+	}
+
+	for _, tt := range tests {
+		e := Entry{Owner: tt.owner}
+		if got := e.OwnedBy(tt.pusher); got != tt.ownedBy {
+			t.Errorf("entry owned by %q: OwnedBy(%q) = %v, want %v", tt.owner, tt.pusher, got, tt.ownedBy)
+		}
+		if got := e.Claimable(tt.pusher); got != tt.claimable {
+			t.Errorf("entry owned by %q: Claimable(%q) = %v, want %v", tt.owner, tt.pusher, got, tt.claimable)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects statistics about push and pull runs
+type Metrics struct {
+	registry *prometheus.Registry
+
+	lastRunTimestamp *prometheus.GaugeVec
+	lastRunSuccess   *prometheus.GaugeVec
+	runDuration      *prometheus.HistogramVec
+	filesUploaded    prometheus.Counter
+	filesDownloaded  prometheus.Counter
+	bytesTransferred *prometheus.CounterVec
+	legoExitCode     *prometheus.GaugeVec
+	certNotAfter     *prometheus.GaugeVec
+	storageSuccess   *prometheus.GaugeVec
+}
+
+// New creates a Metrics instance with its own registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		lastRunTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pushpuller_last_run_timestamp_seconds",
+			Help: "Unix time of the last completed run.",
+		}, []string{"mode"}),
+		lastRunSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pushpuller_last_run_success",
+			Help: "Whether the last run succeeded (1) or failed (0).",
+		}, []string{"mode"}),
+		runDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pushpuller_run_duration_seconds",
+			Help:    "Duration of runs.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+		}, []string{"mode"}),
+		filesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pushpuller_files_uploaded_total",
+			Help: "Number of certificate files uploaded.",
+		}),
+		filesDownloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pushpuller_files_downloaded_total",
+			Help: "Number of certificate files downloaded.",
+		}),
+		bytesTransferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pushpuller_bytes_transferred_total",
+			Help: "Number of encrypted bytes transferred.",
+		}, []string{"direction"}),
+		legoExitCode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pushpuller_lego_command_exit_code",
+			Help: "Exit code of the last run of each lego command (-1 if it could not be run).",
+		}, []string{"index"}),
+		certNotAfter: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pushpuller_certificate_not_after_seconds",
+			Help: "Unix time at which the certificate expires.",
+		}, []string{"certificate"}),
+		storageSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pushpuller_storage_last_success",
+			Help: "Whether the last run could publish to (push) or read from (pull) the storage (1) or not (0).",
+		}, []string{"mode", "storage"}),
+	}
+
+	m.registry.MustRegister(
+		m.lastRunTimestamp,
+		m.lastRunSuccess,
+		m.runDuration,
+		m.filesUploaded,
+		m.filesDownloaded,
+		m.bytesTransferred,
+		m.legoExitCode,
+		m.certNotAfter,
+		m.storageSuccess,
+	)
+
+	return m
+}
+
+// Handler returns an HTTP handler serving the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// WriteTextfile atomically replaces path with the current metrics in the
+// format read by the node_exporter textfile collector
+func (m *Metrics) WriteTextfile(path string) error {
+	if err := prometheus.WriteToTextfile(path, m.registry); err != nil {
+		return fmt.Errorf("write metrics to %s: %w", path, err)
+	}
+	return nil
+}
+
+// ObserveRun records the outcome of a run that started at start
+func (m *Metrics) ObserveRun(mode string, start time.Time, err error) {
+	now := time.Now()
+	m.lastRunTimestamp.WithLabelValues(mode).Set(float64(now.Unix()))
+	m.runDuration.WithLabelValues(mode).Observe(now.Sub(start).Seconds())
+
+	if err != nil {
+		m.lastRunSuccess.WithLabelValues(mode).Set(0)
+	} else {
+		m.lastRunSuccess.WithLabelValues(mode).Set(1)
+	}
+}
+
+// FileUploaded records an uploaded file of size encrypted bytes
+func (m *Metrics) FileUploaded(size int64) {
+	m.filesUploaded.Inc()
+	m.bytesTransferred.WithLabelValues("upload").Add(float64(size))
+}
+
+// FileDownloaded records a downloaded file of size encrypted bytes
+func (m *Metrics) FileDownloaded(size int64) {
+	m.filesDownloaded.Inc()
+	m.bytesTransferred.WithLabelValues("download").Add(float64(size))
+}
+
+// SetLegoExitCode records the exit code of the lego command at index
+// (1-based, matching the log output)
+func (m *Metrics) SetLegoExitCode(index, code int) {
+	m.legoExitCode.WithLabelValues(strconv.Itoa(index)).Set(float64(code))
+}
+
+// SetCertificates replaces the known certificate expiry times
+func (m *Metrics) SetCertificates(notAfter map[string]time.Time) {
+	m.certNotAfter.Reset()
+	for certName, t := range notAfter {
+		m.certNotAfter.WithLabelValues(certName).Set(float64(t.Unix()))
+	}
+}
+
+// ObserveStorage records whether a run could use the named storage
+func (m *Metrics) ObserveStorage(mode, storage string, err error) {
+	if err != nil {
+		m.storageSuccess.WithLabelValues(mode, storage).Set(0)
+	} else {
+		m.storageSuccess.WithLabelValues(mode, storage).Set(1)
+	}
+}
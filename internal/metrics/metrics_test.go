@@ -0,0 +1,87 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.ObserveRun("push", time.Now().Add(-time.Second), nil)
+	m.ObserveRun("pull", time.Now(), errors.New("failed"))
+	m.FileUploaded(100)
+	m.FileDownloaded(50)
+	m.SetLegoExitCode(1, 2)
+	m.ObserveStorage("push", "s3", nil)
+	m.ObserveStorage("push", "mirror", errors.New("unreachable"))
+	m.SetCertificates(map[string]time.Time{"_.example.com": time.Unix(1700000000, 0)})
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+
+	for _, want := range []string{
+		`pushpuller_last_run_success{mode="push"} 1`,
+		`pushpuller_last_run_success{mode="pull"} 0`,
+		`pushpuller_run_duration_seconds_count{mode="push"} 1`,
+		`pushpuller_files_uploaded_total 1`,
+		`pushpuller_files_downloaded_total 1`,
+		`pushpuller_bytes_transferred_total{direction="upload"} 100`,
+		`pushpuller_lego_command_exit_code{index="1"} 2`,
+		`pushpuller_storage_last_success{mode="push",storage="s3"} 1`,
+		`pushpuller_storage_last_success{mode="push",storage="mirror"} 0`,
+		`pushpuller_certificate_not_after_seconds{certificate="_.example.com"} 1.7e+09`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics output missing %q", want)
+		}
+	}
+
+	// Certificates that disappear are dropped
+	m.SetCertificates(nil)
+	recorder = httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ = io.ReadAll(recorder.Body)
+	if strings.Contains(string(body), "_.example.com") {
+		t.Error("Removed certificate should not be reported")
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	m := New()
+	m.ObserveRun("pull", time.Now(), nil)
+
+	path := filepath.Join(t.TempDir(), "test.prom")
+	if err := m.WriteTextfile(path); err != nil {
+		t.Fatalf("WriteTextfile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read textfile: %v", err)
+	}
+
+	if !strings.Contains(string(data), `pushpuller_last_run_success{mode="pull"} 1`) {
+		t.Errorf("Textfile missing run result:\n%s", data)
+	}
+}
@@ -16,14 +16,19 @@ package s3
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	internalConfig "github.com/digilolnet/digilol-cert-pushpuller/internal/config"
 )
 
@@ -61,25 +66,72 @@ func BuildKey(prefix, fileName string) string {
 	return fileName
 }
 
-// LoadHashesFromS3 downloads and parses .hashes.json from S3
-func LoadHashesFromS3(ctx context.Context, client *s3.Client, bucket, prefix string) (map[string]string, error) {
-	hashesKey := BuildKey(prefix, ".hashes.json")
-	hashes := make(map[string]string)
+// Upload streams size bytes from body to the object at key. The payload is
+// sent unsigned so body does not need to be seekable or buffered.
+func Upload(ctx context.Context, client *s3.Client, bucket, key string, body io.Reader, size int64) error {
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &bucket,
+		Key:           &key,
+		Body:          body,
+		ContentLength: &size,
+	},
+		s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware),
+		func(o *s3.Options) {
+			// Checksums would require a seekable body on plain HTTP endpoints
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("upload %s to S3: %w", key, err)
+	}
+	return nil
+}
+
+// ListObjects returns all objects below prefix, following pagination
+func ListObjects(ctx context.Context, client *s3.Client, bucket, prefix string) ([]types.Object, error) {
+	input := &s3.ListObjectsV2Input{Bucket: &bucket}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix + "/")
+	}
 
-	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+	var objects []types.Object
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list S3 objects: %w", err)
+		}
+		objects = append(objects, page.Contents...)
+	}
+	return objects, nil
+}
+
+// Delete removes the object at key
+func Delete(ctx context.Context, client *s3.Client, bucket, key string) error {
+	_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: &bucket,
-		Key:    &hashesKey,
+		Key:    &key,
 	})
 	if err != nil {
-		return hashes, nil // Return empty map if file doesn't exist
+		return fmt.Errorf("delete %s from S3: %w", key, err)
 	}
-	defer output.Body.Close()
+	return nil
+}
 
-	data, err := io.ReadAll(output.Body)
-	if err != nil {
-		return hashes, nil
+// RelativeKey strips the prefix from an object key, reversing BuildKey
+func RelativeKey(prefix, key string) string {
+	if prefix != "" {
+		return strings.TrimPrefix(key, prefix+"/")
 	}
+	return key
+}
 
-	json.Unmarshal(data, &hashes)
-	return hashes, nil
+// IsNotFound reports whether err means the object doesn't exist
+func IsNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
 }
@@ -0,0 +1,181 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Window is a daily time of day range, e.g. 02:00-04:00. A window whose
+// end is before its start spans midnight.
+type Window struct {
+	start, end time.Duration // offsets from midnight
+}
+
+// ParseWindow parses a window in the form "HH:MM-HH:MM"
+func ParseWindow(s string) (*Window, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("window %q: expected HH:MM-HH:MM", s)
+	}
+
+	start, err := parseTimeOfDay(strings.TrimSpace(startStr))
+	if err != nil {
+		return nil, fmt.Errorf("window %q: %w", s, err)
+	}
+	end, err := parseTimeOfDay(strings.TrimSpace(endStr))
+	if err != nil {
+		return nil, fmt.Errorf("window %q: %w", s, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("window %q is empty", s)
+	}
+
+	return &Window{start: start, end: end}, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t falls within the window in t's location
+func (w *Window) Contains(t time.Time) bool {
+	offset := t.Sub(midnight(t))
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// Next returns t if it is within the window, otherwise the next start of
+// the window
+func (w *Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	start := midnight(t).Add(w.start)
+	if !start.After(t) {
+		start = midnight(t.AddDate(0, 0, 1)).Add(w.start)
+	}
+	return start
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Schedule decides when the daemon runs next: either every Interval or
+// at the times of Cron, delayed by up to Jitter and moved into Window if
+// one is set. Failed runs are retried up to RetryAttempts times with
+// exponential backoff starting at RetryBackoff.
+type Schedule struct {
+	Interval      time.Duration
+	Jitter        time.Duration
+	Cron          *Cron
+	Window        *Window
+	RetryAttempts int
+	RetryBackoff  time.Duration
+}
+
+// Next returns the time of the next run after now, or the zero time if
+// the cron expression never matches
+func (s *Schedule) Next(now time.Time) time.Time {
+	next := now.Add(s.Interval)
+	if s.Cron != nil {
+		next = s.Cron.Next(now)
+		if next.IsZero() {
+			return next
+		}
+	}
+
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+
+	if s.Window != nil {
+		next = s.Window.Next(next)
+	}
+
+	return next
+}
+
+// Retry returns the time to retry after the given number of consecutive
+// failures. It returns false if no retries are left or the retry would not
+// happen before the next regular run.
+func (s *Schedule) Retry(now time.Time, failures int) (time.Time, bool) {
+	if failures < 1 || failures > s.RetryAttempts || s.RetryBackoff <= 0 {
+		return time.Time{}, false
+	}
+
+	retry := now.Add(Backoff(s.RetryBackoff, failures))
+	if s.Window != nil {
+		retry = s.Window.Next(retry)
+	}
+
+	if next := s.Next(now); !next.IsZero() && !retry.Before(next) {
+		return time.Time{}, false
+	}
+	return retry, true
+}
+
+// Backoff returns the delay before retry number attempt: base doubled for
+// every previous attempt, randomised to between half and the full value
+// so that many clients failing together don't retry in lockstep
+func Backoff(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < 24*time.Hour; i++ {
+		d *= 2
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Period returns the longest expected time between two runs starting at
+// now, used to decide when the last run is too old
+func (s *Schedule) Period(now time.Time) time.Duration {
+	period := s.Interval
+	if s.Cron != nil {
+		// Look at a week of runs to cover day of week restrictions
+		period = 0
+		prev := s.Cron.Next(now)
+		for i := 0; i < 7*24*60 && !prev.IsZero(); i++ {
+			next := s.Cron.Next(prev)
+			if next.IsZero() || next.Sub(now) > 7*24*time.Hour {
+				break
+			}
+			period = max(period, next.Sub(prev))
+			prev = next
+		}
+		if period == 0 {
+			period = 7 * 24 * time.Hour
+		}
+	}
+
+	// A window can defer runs until the next day
+	if s.Window != nil {
+		period = max(period, 24*time.Hour)
+	}
+
+	return period + s.Jitter
+}
@@ -0,0 +1,180 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"0 0 30 2 *",
+		"0 0 31 4,6,9,11 *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	loc := time.UTC
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		// Twice daily at odd minutes
+		{"17 3,15 * * *", time.Date(2025, 1, 1, 0, 0, 0, 0, loc), time.Date(2025, 1, 1, 3, 17, 0, 0, loc)},
+		{"17 3,15 * * *", time.Date(2025, 1, 1, 3, 17, 0, 0, loc), time.Date(2025, 1, 1, 15, 17, 0, 0, loc)},
+		{"17 3,15 * * *", time.Date(2025, 1, 1, 15, 17, 30, 0, loc), time.Date(2025, 1, 2, 3, 17, 0, 0, loc)},
+		// Steps and ranges
+		{"*/15 * * * *", time.Date(2025, 1, 1, 10, 16, 0, 0, loc), time.Date(2025, 1, 1, 10, 30, 0, 0, loc)},
+		{"0 9-17/4 * * *", time.Date(2025, 1, 1, 14, 0, 0, 0, loc), time.Date(2025, 1, 1, 17, 0, 0, 0, loc)},
+		// Month and year rollover
+		{"0 0 1 * *", time.Date(2025, 12, 15, 0, 0, 0, 0, loc), time.Date(2026, 1, 1, 0, 0, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2025, 3, 1, 0, 0, 0, 0, loc), time.Date(2028, 2, 29, 0, 0, 0, 0, loc)},
+		// 2025-01-01 is a Wednesday, 7 means Sunday
+		{"30 4 * * 7", time.Date(2025, 1, 1, 0, 0, 0, 0, loc), time.Date(2025, 1, 5, 4, 30, 0, 0, loc)},
+		// Both day fields restricted: either matches
+		{"0 0 10 * 1", time.Date(2025, 1, 1, 0, 0, 0, 0, loc), time.Date(2025, 1, 6, 0, 0, 0, 0, loc)},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) failed: %v", tt.expr, err)
+		}
+		if got := c.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%v) = %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	loc := time.UTC
+	day := func(h, m int) time.Time { return time.Date(2025, 1, 1, h, m, 0, 0, loc) }
+
+	w, err := ParseWindow("02:00-04:00")
+	if err != nil {
+		t.Fatalf("ParseWindow failed: %v", err)
+	}
+
+	if !w.Contains(day(2, 0)) || !w.Contains(day(3, 59)) || w.Contains(day(4, 0)) || w.Contains(day(1, 59)) {
+		t.Error("Contains does not match 02:00-04:00")
+	}
+	if got := w.Next(day(3, 0)); !got.Equal(day(3, 0)) {
+		t.Errorf("Next inside window = %v, want unchanged", got)
+	}
+	if got := w.Next(day(1, 0)); !got.Equal(day(2, 0)) {
+		t.Errorf("Next before window = %v, want %v", got, day(2, 0))
+	}
+	if got, want := w.Next(day(5, 0)), day(2, 0).AddDate(0, 0, 1); !got.Equal(want) {
+		t.Errorf("Next after window = %v, want %v", got, want)
+	}
+
+	// Windows may span midnight
+	w, err = ParseWindow("23:00-01:00")
+	if err != nil {
+		t.Fatalf("ParseWindow failed: %v", err)
+	}
+	if !w.Contains(day(23, 30)) || !w.Contains(day(0, 30)) || w.Contains(day(12, 0)) {
+		t.Error("Contains does not match 23:00-01:00")
+	}
+
+	for _, s := range []string{"", "02:00", "02:00-02:00", "25:00-04:00", "2-4"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("ParseWindow(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s := &Schedule{Interval: time.Hour, Jitter: time.Minute}
+	got := s.Next(now)
+	if got.Before(now.Add(time.Hour)) || !got.Before(now.Add(time.Hour+time.Minute)) {
+		t.Errorf("Next = %v, want within jitter of %v", got, now.Add(time.Hour))
+	}
+
+	// Cron takes precedence over the interval and runs are moved into the window
+	c, _ := ParseCron("0 * * * *")
+	w, _ := ParseWindow("02:00-04:00")
+	s = &Schedule{Interval: time.Minute, Cron: c, Window: w}
+	if got, want := s.Next(now), time.Date(2025, 1, 2, 2, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next = %v, want %v", got, want)
+	}
+	if got := s.Period(now); got != 24*time.Hour {
+		t.Errorf("Period = %v, want 24h", got)
+	}
+
+	// Leap days are rare but do match
+	if _, err := ParseCron("0 0 29 2 *"); err != nil {
+		t.Errorf("ParseCron rejected February 29th: %v", err)
+	}
+
+	// A cron that never matches has no next run, regardless of jitter
+	// and window
+	never := &Cron{minute: 1, hour: 1, dom: 1 << 30, month: 1 << 2}
+	if got := never.Next(now); !got.IsZero() {
+		t.Errorf("Cron.Next = %v, want zero time", got)
+	}
+	s = &Schedule{Cron: never, Jitter: time.Hour, Window: w}
+	if got := s.Next(now); !got.IsZero() {
+		t.Errorf("Next = %v, want zero time", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		got := Backoff(time.Second, attempt+1)
+		if got < want/2 || got > want {
+			t.Errorf("Backoff(1s, %d) = %v, want between %v and %v", attempt+1, got, want/2, want)
+		}
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := &Schedule{Interval: time.Hour, RetryAttempts: 3, RetryBackoff: time.Minute}
+
+	if _, ok := s.Retry(now, 0); ok {
+		t.Error("Retry without failures should not retry")
+	}
+	if retry, ok := s.Retry(now, 3); !ok || retry.Before(now.Add(2*time.Minute)) || retry.After(now.Add(4*time.Minute)) {
+		t.Errorf("Retry after 3 failures = %v, %v, want between 2m and 4m", retry, ok)
+	}
+	if _, ok := s.Retry(now, 4); ok {
+		t.Error("Retry should stop after RetryAttempts")
+	}
+
+	// Retries never delay past the next regular run
+	s.RetryAttempts = 10
+	if _, ok := s.Retry(now, 8); ok {
+		t.Error("Retry should give way to the next regular run")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Certificate is a certificate known to the last run
+type Certificate struct {
+	Name     string    `json:"name"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// Storage is the outcome of the last run for one storage
+type Storage struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Status describes the outcome of the last run
+type Status struct {
+	Mode         string        `json:"mode"`
+	LastRun      *time.Time    `json:"last_run"`
+	LastSuccess  *time.Time    `json:"last_success"`
+	Success      bool          `json:"success"`
+	Error        string        `json:"error,omitempty"`
+	ChangedFiles []string      `json:"changed_files"`
+	Certificates []Certificate `json:"certificates"`
+	Storage      []Storage     `json:"storage,omitempty"`
+}
+
+// Tracker keeps the status of the last run. It is safe for concurrent use.
+type Tracker struct {
+	mu      sync.Mutex
+	current Status
+	changed []string
+	storage []Storage
+	maxAge  time.Duration
+}
+
+// FileChanged records a file uploaded or downloaded by the current run
+func (t *Tracker) FileChanged(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.changed = append(t.changed, name)
+}
+
+// StorageUsed records whether the current run could use the named storage
+func (t *Tracker) StorageUsed(name string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := Storage{Name: name, Success: err == nil}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	t.storage = append(t.storage, s)
+}
+
+// RunFinished completes the current run with its error and the
+// certificates present afterwards
+func (t *Tracker) RunFinished(mode string, err error, certs map[string]time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.current.Mode = mode
+	t.current.LastRun = &now
+	t.current.Success = err == nil
+	t.current.Error = ""
+	if err != nil {
+		t.current.Error = err.Error()
+	} else {
+		t.current.LastSuccess = &now
+	}
+
+	t.current.ChangedFiles = t.changed
+	if t.current.ChangedFiles == nil {
+		t.current.ChangedFiles = []string{}
+	}
+	sort.Strings(t.current.ChangedFiles)
+	t.changed = nil
+
+	t.current.Storage = t.storage
+	t.storage = nil
+
+	t.current.Certificates = make([]Certificate, 0, len(certs))
+	for name, notAfter := range certs {
+		t.current.Certificates = append(t.current.Certificates, Certificate{Name: name, NotAfter: notAfter})
+	}
+	sort.Slice(t.current.Certificates, func(i, j int) bool {
+		return t.current.Certificates[i].Name < t.current.Certificates[j].Name
+	})
+}
+
+// Snapshot returns a copy of the current status
+func (t *Tracker) Snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// Ready reports whether the last successful run finished within maxAge
+func (t *Tracker) Ready(maxAge time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current.LastSuccess != nil && time.Since(*t.current.LastSuccess) <= maxAge
+}
+
+// SetReadyMaxAge changes how recent the last successful run must be for
+// /readyz to report ready, e.g. after the schedule was reloaded
+func (t *Tracker) SetReadyMaxAge(maxAge time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxAge = maxAge
+}
+
+// Register adds the /healthz, /readyz and /status endpoints to mux.
+// The daemon is ready if a run succeeded within maxAge, which
+// SetReadyMaxAge can change later.
+func (t *Tracker) Register(mux *http.ServeMux, maxAge time.Duration) {
+	t.SetReadyMaxAge(maxAge)
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		maxAge := t.maxAge
+		t.mu.Unlock()
+
+		if !t.Ready(maxAge) {
+			http.Error(w, "no successful run within "+maxAge.String(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Snapshot())
+	})
+}
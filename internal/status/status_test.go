@@ -0,0 +1,94 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, mux *http.ServeMux, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder
+}
+
+func TestEndpoints(t *testing.T) {
+	tracker := &Tracker{}
+	mux := http.NewServeMux()
+	tracker.Register(mux, time.Hour)
+
+	if code := get(t, mux, "/healthz").Code; code != http.StatusOK {
+		t.Errorf("Expected /healthz 200, got %d", code)
+	}
+
+	// Not ready before the first successful run
+	if code := get(t, mux, "/readyz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 before first run, got %d", code)
+	}
+
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker.FileChanged("b.crt")
+	tracker.FileChanged("a.crt")
+	tracker.StorageUsed("s3", nil)
+	tracker.StorageUsed("mirror", errors.New("unreachable"))
+	tracker.RunFinished("pull", nil, map[string]time.Time{"a": notAfter})
+
+	if code := get(t, mux, "/readyz").Code; code != http.StatusOK {
+		t.Errorf("Expected /readyz 200 after successful run, got %d", code)
+	}
+
+	var status Status
+	if err := json.NewDecoder(get(t, mux, "/status").Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode /status: %v", err)
+	}
+
+	if status.Mode != "pull" || !status.Success || len(status.ChangedFiles) != 2 || status.ChangedFiles[0] != "a.crt" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	if len(status.Storage) != 2 || !status.Storage[0].Success || status.Storage[1].Error != "unreachable" {
+		t.Errorf("Unexpected storage status: %+v", status.Storage)
+	}
+
+	if len(status.Certificates) != 1 || !status.Certificates[0].NotAfter.Equal(notAfter) {
+		t.Errorf("Unexpected certificates: %+v", status.Certificates)
+	}
+
+	// A failed run keeps the last success, so readiness only depends on its age
+	tracker.RunFinished("pull", errors.New("S3 unreachable"), nil)
+	status = tracker.Snapshot()
+	if status.Success || status.Error != "S3 unreachable" || len(status.ChangedFiles) != 0 {
+		t.Errorf("Unexpected status after failure: %+v", status)
+	}
+
+	if !tracker.Ready(time.Hour) {
+		t.Error("Tracker should stay ready after a recent success")
+	}
+
+	if tracker.Ready(0) {
+		t.Error("Tracker should not be ready if the last success is too old")
+	}
+
+	// A reloaded schedule changes the age /readyz accepts
+	tracker.SetReadyMaxAge(0)
+	if code := get(t, mux, "/readyz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 after lowering the max age, got %d", code)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/atomicfile"
+)
+
+// Filesystem stores objects as files below a directory, e.g. a local
+// mirror or a network share served by a web server
+type Filesystem struct {
+	name string
+	dir  string
+
+	// mu makes PutIfMatch atomic within this process. Concurrent pushers
+	// writing to the same directory are not detected.
+	mu sync.Mutex
+}
+
+// NewFilesystem creates a storage for dir
+func NewFilesystem(name, dir string) *Filesystem {
+	return &Filesystem{name: name, dir: dir}
+}
+
+// Name returns the configured name
+func (f *Filesystem) Name() string {
+	return f.name
+}
+
+// path returns the file path of key
+func (f *Filesystem) path(key string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(key))
+}
+
+// Get opens the file of key
+func (f *Filesystem) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("open %s: %w", f.path(key), ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", f.path(key), err)
+	}
+	return file, nil
+}
+
+// GetIfNoneMatch reads the file of key unless the hash of its content
+// still equals etag
+func (f *Filesystem) GetIfNoneMatch(ctx context.Context, key, etag string) ([]byte, string, error) {
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", fmt.Errorf("read %s: %w", f.path(key), ErrNotFound)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", f.path(key), err)
+	}
+
+	current := contentETag(data)
+	if etag != "" && current == etag {
+		return nil, etag, ErrNotModified
+	}
+	return data, current, nil
+}
+
+// Put writes size bytes from body to the file of key, replacing it
+// atomically
+func (f *Filesystem) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	return f.write(key, func(w io.Writer) error {
+		n, err := io.Copy(w, body)
+		if err != nil {
+			return fmt.Errorf("write %s: %w", f.path(key), err)
+		}
+		if n != size {
+			return fmt.Errorf("write %s: expected %d bytes, got %d", f.path(key), size, n)
+		}
+		return nil
+	})
+}
+
+// PutIfMatch replaces the file of key if the hash of its content still
+// equals etag, or creates it if etag is empty
+func (f *Filesystem) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, err := os.ReadFile(f.path(key))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if etag != "" {
+			return "", fmt.Errorf("write %s: %w", f.path(key), ErrConflict)
+		}
+	case err != nil:
+		return "", fmt.Errorf("read %s: %w", f.path(key), err)
+	case etag == "" || contentETag(current) != etag:
+		return "", fmt.Errorf("write %s: %w", f.path(key), ErrConflict)
+	}
+
+	err = f.write(key, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return contentETag(data), nil
+}
+
+// List returns all files below the directory
+func (f *Filesystem) List(ctx context.Context) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(f.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.Contains(d.Name(), atomicfile.TempPattern) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(f.dir, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: filepath.ToSlash(rel), LastModified: info.ModTime()})
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", f.dir, err)
+	}
+	return objects, nil
+}
+
+// Delete removes the file of key and directories left empty by it. Like
+// S3, removing a missing file succeeds.
+func (f *Filesystem) Delete(ctx context.Context, key string) error {
+	path := f.path(key)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+
+	for dir := filepath.Dir(path); dir != filepath.Clean(f.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// write replaces the file of key with the output of fn, creating parent
+// directories as needed
+func (f *Filesystem) write(key string, fn func(w io.Writer) error) error {
+	path := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create directory for %s: %w", path, err)
+	}
+
+	// Objects are encrypted and may be served to pull clients as they are
+	return atomicfile.Write(path, 0644, fn)
+}
+
+// contentETag returns the ETag of a file with the given content
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
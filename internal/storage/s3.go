@@ -0,0 +1,155 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	s3client "github.com/digilolnet/digilol-cert-pushpuller/internal/s3"
+)
+
+// S3 stores objects below a prefix of an S3 bucket
+type S3 struct {
+	name   string
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 creates a storage for the bucket and prefix in cfg
+func NewS3(ctx context.Context, name string, cfg *config.S3Config) (*S3, error) {
+	client, err := s3client.NewClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3{name: name, client: client, bucket: cfg.Bucket, prefix: cfg.Prefix}, nil
+}
+
+// Name returns the configured name
+func (s *S3) Name() string {
+	return s.name
+}
+
+// Get opens the object at key
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s3Key := s3client.BuildKey(s.prefix, key)
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &s3Key,
+	})
+	if s3client.IsNotFound(err) {
+		return nil, fmt.Errorf("download %s from S3: %w", s3Key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download %s from S3: %w", s3Key, err)
+	}
+	return output.Body, nil
+}
+
+// GetIfNoneMatch reads the object at key with If-None-Match set to etag
+func (s *S3) GetIfNoneMatch(ctx context.Context, key, etag string) ([]byte, string, error) {
+	s3Key := s3client.BuildKey(s.prefix, key)
+	input := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &s3Key,
+	}
+	if etag != "" {
+		input.IfNoneMatch = &etag
+	}
+
+	output, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified {
+			return nil, etag, ErrNotModified
+		}
+		if s3client.IsNotFound(err) {
+			return nil, "", fmt.Errorf("download %s from S3: %w", s3Key, ErrNotFound)
+		}
+		return nil, "", fmt.Errorf("download %s from S3: %w", s3Key, err)
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", s3Key, err)
+	}
+	return data, aws.ToString(output.ETag), nil
+}
+
+// Put streams size bytes from body to the object at key
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	return s3client.Upload(ctx, s.client, s.bucket, s3client.BuildKey(s.prefix, key), body, size)
+}
+
+// PutIfMatch replaces the object at key using If-Match, or If-None-Match
+// if etag is empty
+func (s *S3) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error) {
+	s3Key := s3client.BuildKey(s.prefix, key)
+	input := &s3.PutObjectInput{
+		Bucket: &s.bucket,
+		Key:    &s3Key,
+		Body:   bytes.NewReader(data),
+	}
+	if etag != "" {
+		input.IfMatch = &etag
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	output, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) {
+			switch respErr.HTTPStatusCode() {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				return "", fmt.Errorf("upload %s to S3: %w", s3Key, ErrConflict)
+			}
+		}
+		return "", fmt.Errorf("upload %s to S3: %w", s3Key, err)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+// List returns all objects below the prefix
+func (s *S3) List(ctx context.Context) ([]Object, error) {
+	objects, err := s3client.ListObjects(ctx, s.client, s.bucket, s.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Object, 0, len(objects))
+	for _, obj := range objects {
+		result = append(result, Object{
+			Key:          s3client.RelativeKey(s.prefix, aws.ToString(obj.Key)),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+	return result, nil
+}
+
+// Delete removes the object at key
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s3client.Delete(ctx, s.client, s.bucket, s3client.BuildKey(s.prefix, key))
+}
@@ -0,0 +1,174 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	s3client "github.com/digilolnet/digilol-cert-pushpuller/internal/s3"
+)
+
+var (
+	// ErrNotFound is returned when an object doesn't exist
+	ErrNotFound = errors.New("object not found")
+
+	// ErrNotModified is returned by GetIfNoneMatch and LoadManifest when
+	// the object still has the given ETag
+	ErrNotModified = errors.New("not modified")
+
+	// ErrConflict is returned by PutIfMatch and PutManifest when the object
+	// was replaced since it was read
+	ErrConflict = errors.New("changed concurrently")
+)
+
+// Object describes a stored object
+type Object struct {
+	// Key is relative to the storage prefix
+	Key          string
+	LastModified time.Time
+}
+
+// Storage holds the manifest and the encrypted objects push publishes and
+// pull reads. All keys are relative to the configured prefix or directory.
+type Storage interface {
+	// Name identifies the storage in logs, metrics and the status endpoint
+	Name() string
+
+	// Get opens the object at key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// GetIfNoneMatch reads the object at key unless its ETag still equals
+	// etag. Returns the data and the current ETag.
+	GetIfNoneMatch(ctx context.Context, key, etag string) ([]byte, string, error)
+
+	// Put streams size bytes from body to the object at key
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+
+	// PutIfMatch replaces the object at key only if it still has the given
+	// ETag, or doesn't exist yet if etag is empty. Returns the new ETag.
+	PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error)
+
+	// List returns all objects
+	List(ctx context.Context) ([]Object, error)
+
+	// Delete removes the object at key. Deleting a missing object succeeds.
+	Delete(ctx context.Context, key string) error
+}
+
+// New creates the storage described by cfg
+func New(ctx context.Context, cfg *config.StorageConfig) (Storage, error) {
+	if cfg.Path != "" {
+		return NewFilesystem(cfg.Name, cfg.Path), nil
+	}
+	return NewS3(ctx, cfg.Name, &cfg.S3)
+}
+
+// Download reads the whole object at key into memory
+func Download(ctx context.Context, st Storage, key string) ([]byte, error) {
+	r, err := st.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// LogKey returns key as logged in the s3_key field: the full object key
+// including the prefix for S3, relative to the directory otherwise
+func LogKey(st Storage, key string) string {
+	if s, ok := st.(*S3); ok {
+		return s3client.BuildKey(s.prefix, key)
+	}
+	return key
+}
+
+// LoadManifest downloads and parses the manifest unless its ETag still
+// equals etag, in which case it returns ErrNotModified. Returns the
+// manifest and its current ETag. If there is no manifest yet, the legacy
+// .hashes.json is converted instead and the ETag is empty.
+func LoadManifest(ctx context.Context, st Storage, etag string) (*manifest.Manifest, string, error) {
+	data, newETag, err := st.GetIfNoneMatch(ctx, manifest.FileName, etag)
+	if errors.Is(err, ErrNotModified) {
+		return nil, etag, err
+	}
+	if errors.Is(err, ErrNotFound) {
+		m, err := loadLegacyManifest(ctx, st)
+		return m, "", err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", manifest.FileName, err)
+	}
+	return m, newETag, nil
+}
+
+// PutManifest replaces the manifest only if it still has the given ETag,
+// or doesn't exist yet if etag is empty. Returns ErrConflict if another
+// pusher replaced it in the meantime, otherwise the new ETag.
+func PutManifest(ctx context.Context, st Storage, m *manifest.Manifest, etag string) (string, error) {
+	data, err := m.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return st.PutIfMatch(ctx, manifest.FileName, data, etag)
+}
+
+// loadLegacyManifest converts .hashes.json of older versions. A missing
+// file results in an empty manifest.
+func loadLegacyManifest(ctx context.Context, st Storage) (*manifest.Manifest, error) {
+	hashes := make(map[string]string)
+	data, err := Download(ctx, st, manifest.LegacyFileName)
+	if errors.Is(err, ErrNotFound) {
+		return manifest.FromLegacy(hashes, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", manifest.LegacyFileName, err)
+	}
+
+	// Legacy manifests don't record which objects have a wrapped data key
+	objects, err := st.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keys[obj.Key] = true
+	}
+
+	m := manifest.FromLegacy(hashes, keys)
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", manifest.LegacyFileName, err)
+	}
+	return m, nil
+}
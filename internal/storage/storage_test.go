@@ -0,0 +1,178 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+)
+
+func TestFilesystem(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st := NewFilesystem("mirror", dir)
+
+	key := manifest.NewObjectKey("a.example.com.crt", "abc")
+	if err := st.Put(ctx, key, strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	data, err := Download(ctx, st, key)
+	if err != nil || string(data) != "data" {
+		t.Errorf("Download returned %q, %v", data, err)
+	}
+
+	if _, err := Download(ctx, st, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for missing object, got %v", err)
+	}
+
+	// Short bodies must not replace the object
+	if err := st.Put(ctx, key, strings.NewReader("da"), 4); err == nil {
+		t.Error("Put should fail if the body is shorter than size")
+	}
+
+	objects, err := st.List(ctx)
+	if err != nil || len(objects) != 1 || objects[0].Key != key {
+		t.Errorf("List returned %+v, %v", objects, err)
+	}
+
+	// Deleting the last object removes its directories
+	if err := st.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected empty directory after Delete, got %v, %v", entries, err)
+	}
+	if err := st.Delete(ctx, key); err != nil {
+		t.Errorf("Deleting a missing object failed: %v", err)
+	}
+}
+
+func TestFilesystemConditional(t *testing.T) {
+	ctx := context.Background()
+	st := NewFilesystem("mirror", t.TempDir())
+
+	etag, err := st.PutIfMatch(ctx, "m.json", []byte("v1"), "")
+	if err != nil {
+		t.Fatalf("PutIfMatch failed to create: %v", err)
+	}
+
+	if _, err := st.PutIfMatch(ctx, "m.json", []byte("v1"), ""); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict creating an existing object, got %v", err)
+	}
+	if _, err := st.PutIfMatch(ctx, "other.json", []byte("v1"), etag); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict replacing a missing object, got %v", err)
+	}
+
+	if _, _, err := st.GetIfNoneMatch(ctx, "m.json", etag); !errors.Is(err, ErrNotModified) {
+		t.Errorf("Expected ErrNotModified, got %v", err)
+	}
+
+	newETag, err := st.PutIfMatch(ctx, "m.json", []byte("v2"), etag)
+	if err != nil {
+		t.Fatalf("PutIfMatch failed to replace: %v", err)
+	}
+	if _, err := st.PutIfMatch(ctx, "m.json", []byte("v3"), etag); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict with stale ETag, got %v", err)
+	}
+
+	data, current, err := st.GetIfNoneMatch(ctx, "m.json", etag)
+	if err != nil || string(data) != "v2" || current != newETag {
+		t.Errorf("GetIfNoneMatch returned %q, %q, %v", data, current, err)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st := NewFilesystem("mirror", dir)
+
+	// Nothing published yet
+	m, etag, err := LoadManifest(ctx, st, "")
+	if err != nil || len(m.Files) != 0 || etag != "" {
+		t.Fatalf("LoadManifest on empty storage returned %+v, %q, %v", m, etag, err)
+	}
+
+	// Legacy layout with a wrapped data key next to one object
+	files := map[string]string{
+		manifest.LegacyFileName:     `{"a.example.com.crt":"abc","a.example.com.key":"def"}`,
+		"a.example.com.crt.enc":     "x",
+		"a.example.com.crt.enc.dek": "x",
+		"a.example.com.key.enc":     "x",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	m, etag, err = LoadManifest(ctx, st, "")
+	if err != nil || etag != "" {
+		t.Fatalf("LoadManifest on legacy layout returned %q, %v", etag, err)
+	}
+	if e := m.Files["a.example.com.crt"]; e.Object != "a.example.com.crt.enc" || !e.DEK {
+		t.Errorf("Unexpected legacy entry: %+v", e)
+	}
+	if e := m.Files["a.example.com.key"]; e.DEK {
+		t.Errorf("Unexpected legacy entry: %+v", e)
+	}
+
+	// The manifest takes precedence once published
+	m.Version = manifest.Version
+	etag, err = PutManifest(ctx, st, m, "")
+	if err != nil {
+		t.Fatalf("PutManifest failed: %v", err)
+	}
+
+	if _, _, err := LoadManifest(ctx, st, etag); !errors.Is(err, ErrNotModified) {
+		t.Errorf("Expected ErrNotModified, got %v", err)
+	}
+
+	loaded, _, err := LoadManifest(ctx, st, "")
+	if err != nil || !loaded.Equal(m) {
+		t.Errorf("LoadManifest returned %+v, %v", loaded, err)
+	}
+}
+
+func TestLoadManifestRejectsUnsafeLegacyNames(t *testing.T) {
+	dir := t.TempDir()
+	st := NewFilesystem("mirror", dir)
+
+	data := `{"../../etc/x.crt":"abc"}`
+	if err := os.WriteFile(filepath.Join(dir, manifest.LegacyFileName), []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write legacy manifest: %v", err)
+	}
+
+	if _, _, err := LoadManifest(context.Background(), st, ""); err == nil {
+		t.Error("LoadManifest accepted a file name outside the certificate directory")
+	}
+}
+
+func TestLogKey(t *testing.T) {
+	key := "objects/x.crt/abc.enc"
+	if got := LogKey(&S3{prefix: "certs"}, key); got != "certs/"+key {
+		t.Errorf("S3 key is %q, want %q", got, "certs/"+key)
+	}
+	if got := LogKey(NewFilesystem("fs", t.TempDir()), key); got != key {
+		t.Errorf("Filesystem key is %q, want %q", got, key)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the request as
+	// "sha256=<hex>"
+	SignatureHeader = "X-Pushpuller-Signature"
+
+	// TimestampHeader carries the Unix time the request was signed at
+	TimestampHeader = "X-Pushpuller-Timestamp"
+
+	// MaxSkew is how far the timestamp of a request may be from the local
+	// clock, limiting replays of captured requests
+	MaxSkew = 5 * time.Minute
+
+	// maxBodySize limits the request body read before verification
+	maxBodySize = 1 << 20
+)
+
+// ErrUnauthorized is returned for requests without a valid signature or
+// token
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Sign returns the signature of body sent at timestamp
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a request with the
+// given body
+func Verify(secret []byte, header http.Header, body []byte, now time.Time) error {
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing or invalid timestamp", ErrUnauthorized)
+	}
+
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > MaxSkew || skew < -MaxSkew {
+		return fmt.Errorf("%w: timestamp too far from local time", ErrUnauthorized)
+	}
+
+	want := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(want)) {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	}
+
+	return nil
+}
+
+// Handler calls Trigger for POST requests signed with Secret or, e.g. for
+// S3 bucket notification webhooks that can't sign requests, carrying
+// Token as a bearer token. Either may be nil to disable it.
+type Handler struct {
+	Secret  []byte
+	Token   []byte
+	Trigger func()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !h.authorized(r.Header, body) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.Trigger()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) authorized(header http.Header, body []byte) bool {
+	if h.Token != nil {
+		token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), h.Token) == 1 {
+			return true
+		}
+	}
+
+	if h.Secret != nil {
+		return Verify(h.Secret, header, body, time.Now()) == nil
+	}
+
+	return false
+}
+
+// Notify sends body to url as a POST request signed with secret
+func Notify(ctx context.Context, client *http.Client, url string, secret, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request for %s: %w", url, err)
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify %s: unexpected status %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trigger
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"bucket":"certs"}`)
+	now := time.Unix(1700000000, 0)
+
+	header := func(timestamp int64, signature string) http.Header {
+		h := http.Header{}
+		h.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+		h.Set(SignatureHeader, signature)
+		return h
+	}
+
+	if err := Verify(secret, header(now.Unix(), Sign(secret, now.Unix(), body)), body, now); err != nil {
+		t.Errorf("Verify failed for valid signature: %v", err)
+	}
+
+	tests := map[string]http.Header{
+		"wrong secret": header(now.Unix(), Sign([]byte("other"), now.Unix(), body)),
+		"changed body": header(now.Unix(), Sign(secret, now.Unix(), []byte("{}"))),
+		"old request":  header(now.Add(-10*time.Minute).Unix(), Sign(secret, now.Add(-10*time.Minute).Unix(), body)),
+		"no timestamp": {SignatureHeader: []string{Sign(secret, now.Unix(), body)}},
+		"no signature": {TimestampHeader: []string{strconv.FormatInt(now.Unix(), 10)}},
+	}
+	for name, h := range tests {
+		if err := Verify(secret, h, body, now); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: Verify = %v, want ErrUnauthorized", name, err)
+		}
+	}
+}
+
+func TestNotifyHandler(t *testing.T) {
+	triggered := 0
+	handler := &Handler{
+		Secret:  []byte("secret"),
+		Token:   []byte("token"),
+		Trigger: func() { triggered++ },
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx := context.Background()
+	body := []byte(`{"bucket":"certs"}`)
+
+	if err := Notify(ctx, server.Client(), server.URL, []byte("secret"), body); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if triggered != 1 {
+		t.Errorf("triggered %d times, want 1", triggered)
+	}
+
+	if err := Notify(ctx, server.Client(), server.URL, []byte("wrong"), body); err == nil {
+		t.Error("Notify with wrong secret should fail")
+	}
+
+	// Bearer tokens for webhooks that can't sign requests
+	for token, want := range map[string]int{"token": http.StatusAccepted, "wrong": http.StatusUnauthorized} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: status %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	if triggered != 2 {
+		t.Errorf("triggered %d times, want 2", triggered)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+)
+
+// rewrapKeys rewrites every key in the key directory either wrapped with
+// the configured passphrase or as plain base64
+func rewrapKeys(cfg *config.KeyConfig, wrap bool) error {
+	passphrase, err := cfg.KeyPassphrase.Load()
+	if err != nil {
+		return fmt.Errorf("load key passphrase: %w", err)
+	}
+	if passphrase == nil {
+		return fmt.Errorf("no key_passphrase source configured")
+	}
+
+	certNames, err := config.ListKeys(cfg.KeyDir)
+	if err != nil {
+		return err
+	}
+
+	var target []byte
+	if wrap {
+		target = passphrase
+	}
+
+	for _, certName := range certNames {
+		// LoadKey accepts both formats, so already migrated keys are
+		// simply rewritten
+		key, err := config.LoadKey(cfg.KeyDir, certName, passphrase)
+		if err != nil {
+			return err
+		}
+
+		if err := config.SaveKey(cfg.KeyDir, certName, key, target); err != nil {
+			return err
+		}
+
+		if wrap {
+			log.Printf("wrapped %s", certName)
+		} else {
+			log.Printf("unwrapped %s", certName)
+		}
+	}
+
+	return nil
+}
@@ -15,33 +15,82 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/bundle"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/command"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/metrics"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/status"
 )
 
+// runMetrics collects statistics of all runs in this process
+var runMetrics = metrics.New()
+
+// runStatus tracks the outcome of the last run for the status endpoints
+var runStatus = &status.Tracker{}
+
 func main() {
 	log.SetFlags(0)
 
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: digilol-cert-pushpuller <push|pull> --config /path/to/config.toml")
-		os.Exit(1)
+		usage()
 	}
 
 	command := os.Args[1]
+	args := os.Args[2:]
+
+	// The key command has its own subcommands
+	if command == "key" {
+		if len(args) < 1 {
+			usage()
+		}
+		command = "key " + args[0]
+		args = args[1:]
+	}
 
 	// Parse common flags
 	var configPath string
 	fs := flag.NewFlagSet(command, flag.ExitOnError)
 	fs.StringVar(&configPath, "config", "", "Path to config file")
-	fs.Parse(os.Args[2:])
+
+	// Bundle flags
+	var client, certs, bundlePath, passphraseFile, s3AccessKey, s3SecretKey string
+	creds := make(map[string]s3Credentials)
+	switch command {
+	case "enroll":
+		fs.StringVar(&client, "client", "", "Name of the client being enrolled")
+		fs.StringVar(&certs, "certs", "", "Comma separated certificate names to include")
+		fs.StringVar(&bundlePath, "out", "", "Write bundle to file instead of stdout")
+		fs.StringVar(&passphraseFile, "passphrase-file", "", "Encrypt bundle with passphrase from file")
+		fs.StringVar(&s3AccessKey, "s3-access-key", "", "S3 access key for the client, preferably read-only")
+		fs.StringVar(&s3SecretKey, "s3-secret-key", "", "S3 secret key for the client")
+		fs.Func("credentials", "S3 credentials for the client of an S3 destination as name=ACCESS_KEY:SECRET_KEY (repeatable)", func(value string) error {
+			name, c, err := parseCredentials(value)
+			if err != nil {
+				return err
+			}
+			creds[name] = c
+			return nil
+		})
+	case "import-bundle":
+		fs.StringVar(&bundlePath, "in", "", "Read bundle from file instead of stdin")
+		fs.StringVar(&passphraseFile, "passphrase-file", "", "Decrypt bundle with passphrase from file")
+	}
+
+	fs.Parse(args)
 
 	if configPath == "" {
 		log.Fatal("--config is required")
@@ -54,11 +103,19 @@ func main() {
 			log.Fatalf("failed to load config: %v", err)
 		}
 
+		if err := setupLogging(cfg.Log); err != nil {
+			log.Fatalf("failed to set up logging: %v", err)
+		}
+
 		if cfg.Daemon.Enabled {
-			runPushDaemon(cfg)
+			runPushDaemon(configPath, cfg)
 		} else {
-			if err := push(cfg); err != nil {
-				log.Fatalf("push failed: %v", err)
+			// Errors are logged by runPush
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			err := runPush(ctx, cfg)
+			stop()
+			if err != nil {
+				os.Exit(1)
 			}
 		}
 
@@ -68,71 +125,172 @@ func main() {
 			log.Fatalf("failed to load config: %v", err)
 		}
 
+		if err := setupLogging(cfg.Log); err != nil {
+			log.Fatalf("failed to set up logging: %v", err)
+		}
+
 		if cfg.Daemon.Enabled {
-			runPullDaemon(cfg)
+			runPullDaemon(configPath, cfg)
 		} else {
-			if err := pull(cfg); err != nil {
-				log.Fatalf("pull failed: %v", err)
+			// Errors are logged by runPull
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			err := runPull(ctx, cfg)
+			stop()
+			if err != nil {
+				os.Exit(pullExitCode(err))
 			}
 		}
 
+	case "key wrap", "key unwrap":
+		cfg, err := config.LoadKeyConfig(configPath)
+		if err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
+
+		if err := rewrapKeys(cfg, command == "key wrap"); err != nil {
+			log.Fatalf("%s failed: %v", command, err)
+		}
+
+	case "enroll":
+		if client == "" || certs == "" {
+			log.Fatal("--client and --certs are required")
+		}
+
+		cfg, err := config.LoadPush(configPath)
+		if err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
+
+		passphrase, err := config.PassphraseConfig{File: passphraseFile}.Load()
+		if err != nil {
+			log.Fatalf("failed to load bundle passphrase: %v", err)
+		}
+
+		if s3AccessKey != "" || s3SecretKey != "" {
+			creds["s3"] = s3Credentials{accessKey: s3AccessKey, secretKey: s3SecretKey}
+		}
+		b, err := enroll(cfg, client, strings.Split(certs, ","), creds)
+		if err != nil {
+			log.Fatalf("enroll failed: %v", err)
+		}
+
+		data, err := bundle.Encode(b, passphrase)
+		if err != nil {
+			log.Fatalf("enroll failed: %v", err)
+		}
+
+		if bundlePath == "" {
+			os.Stdout.Write(data)
+		} else if err := os.WriteFile(bundlePath, data, 0600); err != nil {
+			log.Fatalf("failed to write bundle: %v", err)
+		}
+
+	case "import-bundle":
+		passphrase, err := config.PassphraseConfig{File: passphraseFile}.Load()
+		if err != nil {
+			log.Fatalf("failed to load bundle passphrase: %v", err)
+		}
+
+		var data []byte
+		if bundlePath == "" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(bundlePath)
+		}
+		if err != nil {
+			log.Fatalf("failed to read bundle: %v", err)
+		}
+
+		b, err := bundle.Decode(data, passphrase)
+		if err != nil {
+			log.Fatalf("import-bundle failed: %v", err)
+		}
+
+		if err := importBundle(configPath, b); err != nil {
+			log.Fatalf("import-bundle failed: %v", err)
+		}
+
 	default:
 		log.Fatalf("unknown command: %s", command)
 	}
 }
 
-func runDaemon(name string, intervalSecs, jitterSecs int, fn func() error) {
-	if jitterSecs > 0 {
-		log.Printf("starting %s daemon (interval: %ds, jitter: %ds)", name, intervalSecs, jitterSecs)
-	} else {
-		log.Printf("starting %s daemon (interval: %ds)", name, intervalSecs)
+// Exit codes of a failed run
+const (
+	exitFailure        = 1
+	exitPartialFailure = 2
+)
+
+// pullExitCode tells apart pulls where only some files failed from pulls
+// that failed entirely
+func pullExitCode(err error) int {
+	var partial *partialFailureError
+	if errors.As(err, &partial) {
+		return exitPartialFailure
 	}
+	return exitFailure
+}
 
-	// Set up signal handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+func usage() {
+	fmt.Println("Usage: digilol-cert-pushpuller <push|pull|key wrap|key unwrap|enroll|import-bundle> --config /path/to/config.toml")
+	os.Exit(1)
+}
 
-	// Seed random for jitter
-	if jitterSecs > 0 {
-		rand.Seed(time.Now().UnixNano())
-	}
+// runPush runs push and records its outcome in runMetrics
+func runPush(ctx context.Context, cfg *config.PushConfig) error {
+	return instrument("push", cfg.CertDir, cfg.Metrics.TextfileDir, func() error {
+		return push(ctx, cfg)
+	})
+}
+
+// runPushChanges runs pushChanges and records its outcome in runMetrics
+func runPushChanges(ctx context.Context, cfg *config.PushConfig) error {
+	return instrument("push", cfg.CertDir, cfg.Metrics.TextfileDir, func() error {
+		return pushChanges(ctx, cfg)
+	})
+}
 
-	// Run immediately on startup
-	if err := fn(); err != nil {
-		log.Printf("%s failed: %v", name, err)
+// runPull runs pull and records its outcome in runMetrics
+func runPull(ctx context.Context, cfg *config.PullConfig) error {
+	return instrument("pull", cfg.CertDir, cfg.Metrics.TextfileDir, func() error {
+		return pull(ctx, cfg)
+	})
+}
+
+// commandOptions converts timeout and retry settings from the config
+func commandOptions(timeoutSecs, retries, retryDelaySecs int) command.Options {
+	return command.Options{
+		Timeout:    time.Duration(timeoutSecs) * time.Second,
+		Retries:    retries,
+		RetryDelay: time.Duration(retryDelaySecs) * time.Second,
 	}
+}
 
-	ticker := time.NewTicker(time.Duration(intervalSecs) * time.Second)
-	defer ticker.Stop()
+// instrument runs fn, logs and records its outcome and certificate expiry times in
+// runMetrics and runStatus and writes the metrics to textfileDir if it is set
+func instrument(mode, certDir, textfileDir string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	runMetrics.ObserveRun(mode, start, err)
 
-	for {
-		select {
-		case <-ticker.C:
-			// Apply jitter if configured
-			if jitterSecs > 0 {
-				jitter := time.Duration(rand.Intn(jitterSecs)) * time.Second
-				time.Sleep(jitter)
-			}
+	if err != nil {
+		slog.Error("run failed", "mode", mode, "duration", time.Since(start), "error", err)
+	} else {
+		slog.Info("run finished", "mode", mode, "duration", time.Since(start))
+	}
 
-			if err := fn(); err != nil {
-				log.Printf("%s failed: %v", name, err)
-			}
+	expiry, certErr := config.CertificateExpiry(certDir)
+	if certErr == nil {
+		runMetrics.SetCertificates(expiry)
+	}
+	runStatus.RunFinished(mode, err, expiry)
 
-		case sig := <-sigChan:
-			log.Printf("received signal %v, shutting down", sig)
-			return
+	if textfileDir != "" {
+		path := filepath.Join(textfileDir, "digilol-cert-pushpuller-"+mode+".prom")
+		if writeErr := runMetrics.WriteTextfile(path); writeErr != nil {
+			slog.Error("failed to write metrics", "mode", mode, "path", path, "error", writeErr)
 		}
 	}
-}
 
-func runPushDaemon(cfg *config.PushConfig) {
-	runDaemon("push", cfg.Daemon.IntervalSecs, cfg.Daemon.JitterSecs, func() error {
-		return push(cfg)
-	})
-}
-
-func runPullDaemon(cfg *config.PullConfig) {
-	runDaemon("pull", cfg.Daemon.IntervalSecs, cfg.Daemon.JitterSecs, func() error {
-		return pull(cfg)
-	})
+	return err
 }
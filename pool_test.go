@@ -0,0 +1,98 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrency records the most calls running at once
+type concurrency struct {
+	running, peak atomic.Int32
+}
+
+// enter records a running call until the returned function is called
+func (c *concurrency) enter() func() {
+	n := c.running.Add(1)
+	for {
+		p := c.peak.Load()
+		if n <= p || c.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	return func() { c.running.Add(-1) }
+}
+
+func TestForEachLimit(t *testing.T) {
+	items := make([]int, 20)
+	for i := range items {
+		items[i] = i
+	}
+
+	var (
+		calls atomic.Int32
+		c     concurrency
+	)
+	errOdd := errors.New("odd item")
+	err := forEachLimit(3, items, func(i int) error {
+		calls.Add(1)
+		defer c.enter()()
+		time.Sleep(10 * time.Millisecond)
+		if i%2 == 1 {
+			return fmt.Errorf("item %d: %w", i, errOdd)
+		}
+		return nil
+	})
+
+	if calls.Load() != int32(len(items)) {
+		t.Errorf("fn was called %d times, want %d", calls.Load(), len(items))
+	}
+	if c.peak.Load() > 3 {
+		t.Errorf("%d calls ran at once, limit is 3", c.peak.Load())
+	}
+	if c.peak.Load() < 2 {
+		t.Errorf("Calls did not run concurrently, peak %d", c.peak.Load())
+	}
+
+	// Every failure is reported, not just the first
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != len(items)/2 {
+		t.Fatalf("Expected %d joined errors, got %v", len(items)/2, err)
+	}
+	for _, e := range joined.Unwrap() {
+		if !errors.Is(e, errOdd) {
+			t.Errorf("Unexpected error %v", e)
+		}
+	}
+}
+
+func TestForEachLimitDefault(t *testing.T) {
+	var c concurrency
+	err := forEachLimit(0, make([]struct{}, 3*defaultConcurrency), func(struct{}) error {
+		defer c.enter()()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("forEachLimit failed: %v", err)
+	}
+	if c.peak.Load() > defaultConcurrency {
+		t.Errorf("%d calls ran at once, default limit is %d", c.peak.Load(), defaultConcurrency)
+	}
+}
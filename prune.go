@@ -0,0 +1,176 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/storage"
+)
+
+// orphansFile records in the storage when objects were first found unreferenced, so
+// they can be kept for their retention period
+const orphansFile = ".orphans.json"
+
+// defaultGCGrace is how long old generations are kept after the manifest
+// stopped referring to them, so pullers still working from the previous
+// manifest can finish
+const defaultGCGrace = time.Hour
+
+// collectGarbage deletes objects the manifest doesn't refer to. Old
+// generations of current files are deleted after cfg.GCGraceSecs, objects
+// of removed certificate files only with cfg.Prune after
+// cfg.PruneRetentionSecs.
+func collectGarbage(ctx context.Context, cfg *config.PushConfig, st storage.Storage, logger *slog.Logger, m *manifest.Manifest) error {
+	objects, err := st.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	gcGrace := time.Duration(cfg.GCGraceSecs) * time.Second
+	if cfg.GCGraceSecs <= 0 {
+		gcGrace = defaultGCGrace
+	}
+	pruneRetention := time.Duration(cfg.PruneRetentionSecs) * time.Second
+
+	// Find objects the manifest doesn't refer to and how long to keep them.
+	// Recent objects may belong to a manifest another pusher is about to
+	// publish.
+	referenced := m.Referenced()
+	retention := make(map[string]time.Duration)
+	for _, obj := range objects {
+		if referenced[obj.Key] {
+			continue
+		}
+		if time.Since(obj.LastModified) < gcGrace {
+			continue
+		}
+
+		fileName, ok := manifest.ObjectFileName(obj.Key)
+		if !ok {
+			continue
+		}
+
+		if _, current := m.Files[fileName]; current {
+			retention[obj.Key] = gcGrace
+		} else if cfg.Prune {
+			retention[obj.Key] = pruneRetention
+		}
+	}
+
+	// Load when objects were first seen unreferenced. Objects referenced
+	// again are dropped from it.
+	seen := make(map[string]time.Time)
+	if data, err := storage.Download(ctx, st, orphansFile); err == nil {
+		json.Unmarshal(data, &seen)
+	}
+
+	now := time.Now().UTC()
+	remaining := make(map[string]time.Time)
+	for key, keep := range retention {
+		first, ok := seen[key]
+		if !ok {
+			first = now
+			if keep > 0 {
+				logger.Debug("found unreferenced object", "s3_key", storage.LogKey(st, key), "delete_after", first.Add(keep))
+			}
+		}
+
+		if now.Sub(first) < keep {
+			remaining[key] = first
+			continue
+		}
+
+		if err := st.Delete(ctx, key); err != nil {
+			// Try again next run
+			remaining[key] = first
+			logger.Error("failed to delete unreferenced object", "s3_key", storage.LogKey(st, key), "error", err)
+			continue
+		}
+		logger.Info("deleted unreferenced object", "s3_key", storage.LogKey(st, key), "unreferenced_since", first)
+	}
+
+	if len(remaining) == 0 {
+		if len(seen) == 0 {
+			return nil
+		}
+		return st.Delete(ctx, orphansFile)
+	}
+
+	data, err := json.Marshal(remaining)
+	if err != nil {
+		return fmt.Errorf("marshal orphans: %w", err)
+	}
+	data = append(data, '\n')
+	return st.Put(ctx, orphansFile, bytes.NewReader(data), int64(len(data)))
+}
+
+// pruneLocal removes certificate files from cfg.CertDir that are no longer
+// in the manifest, or moves them to cfg.PruneArchiveDir if it is set.
+// Returns the number of files pruned.
+func pruneLocal(cfg *config.PullConfig, logger *slog.Logger, m *manifest.Manifest) (int, error) {
+	entries, err := os.ReadDir(cfg.CertDir)
+	if err != nil {
+		return 0, fmt.Errorf("read certificate directory %s: %w", cfg.CertDir, err)
+	}
+
+	if cfg.PruneArchiveDir != "" {
+		if err := os.MkdirAll(cfg.PruneArchiveDir, 0700); err != nil {
+			return 0, fmt.Errorf("create archive directory %s: %w", cfg.PruneArchiveDir, err)
+		}
+	}
+
+	pruned := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if _, isCert := config.ExtractCertName(name); !isCert {
+			continue
+		}
+		if _, current := m.Files[name]; current {
+			continue
+		}
+
+		path := filepath.Join(cfg.CertDir, name)
+		if cfg.PruneArchiveDir != "" {
+			archivePath := filepath.Join(cfg.PruneArchiveDir, name+"."+time.Now().UTC().Format("20060102T150405Z"))
+			if err := os.Rename(path, archivePath); err != nil {
+				return pruned, fmt.Errorf("archive %s: %w", path, err)
+			}
+			logger.Info("archived removed certificate file", "file", name, "path", archivePath)
+		} else {
+			if err := os.Remove(path); err != nil {
+				return pruned, fmt.Errorf("remove %s: %w", path, err)
+			}
+			logger.Info("removed certificate file", "file", name)
+		}
+
+		runStatus.FileChanged(name)
+		pruned++
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/storage"
+)
+
+// putObject stores an object that was last modified age ago
+func putObject(t *testing.T, dir string, st storage.Storage, key string, age time.Duration) {
+	t.Helper()
+	if err := st.Put(context.Background(), key, strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), modified, modified); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+}
+
+// loadOrphans returns the bookkeeping of unreferenced objects
+func loadOrphans(t *testing.T, st storage.Storage) map[string]time.Time {
+	t.Helper()
+	orphans := make(map[string]time.Time)
+	data, err := storage.Download(context.Background(), st, orphansFile)
+	if err == nil {
+		err = json.Unmarshal(data, &orphans)
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Failed to load orphans: %v", err)
+	}
+	return orphans
+}
+
+// backdateOrphans pretends all unreferenced objects were found age ago
+func backdateOrphans(t *testing.T, st storage.Storage, age time.Duration) {
+	t.Helper()
+	orphans := loadOrphans(t, st)
+	for key := range orphans {
+		orphans[key] = time.Now().UTC().Add(-age)
+	}
+	data, _ := json.Marshal(orphans)
+	if err := st.Put(context.Background(), orphansFile, strings.NewReader(string(data)), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+}
+
+// exists reports which of keys are stored in st
+func exists(t *testing.T, st storage.Storage, keys ...string) map[string]bool {
+	t.Helper()
+	objects, err := st.List(context.Background())
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	stored := make(map[string]bool)
+	for _, obj := range objects {
+		stored[obj.Key] = true
+	}
+	result := make(map[string]bool)
+	for _, key := range keys {
+		result[key] = stored[key]
+	}
+	return result
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.DiscardHandler)
+	dir := t.TempDir()
+	st := storage.NewFilesystem("test", dir)
+
+	const (
+		current = "objects/a.example.com.crt/new-A.enc"
+		old     = "objects/a.example.com.crt/old-B.enc"
+		oldDEK  = old + ".dek"
+		recent  = "objects/a.example.com.crt/racing-C.enc"
+		removed = "objects/gone.example.com.crt/old-D.enc"
+		foreign = "backup.enc"
+	)
+	putObject(t, dir, st, current, 2*time.Hour)
+	putObject(t, dir, st, old, 2*time.Hour)
+	putObject(t, dir, st, oldDEK, 2*time.Hour)
+	putObject(t, dir, st, recent, 0)
+	putObject(t, dir, st, removed, 2*time.Hour)
+	putObject(t, dir, st, foreign, 2*time.Hour)
+
+	m := manifest.New()
+	m.Files["a.example.com.crt"] = manifest.Entry{Object: current}
+	cfg := &config.PushConfig{GCGraceSecs: 60, PruneRetentionSecs: 3600}
+
+	// Old generations are recorded and kept for the grace period. Recent
+	// objects may belong to another pusher's manifest, objects of removed
+	// files are only deleted with prune.
+	if err := collectGarbage(ctx, cfg, st, logger, m); err != nil {
+		t.Fatalf("collectGarbage failed: %v", err)
+	}
+	orphans := loadOrphans(t, st)
+	if len(orphans) != 2 || orphans[old].IsZero() || orphans[oldDEK].IsZero() {
+		t.Errorf("Unexpected orphans %v", orphans)
+	}
+	for key, ok := range exists(t, st, current, old, oldDEK, recent, removed) {
+		if !ok {
+			t.Errorf("%s was deleted within its grace period", key)
+		}
+	}
+
+	// Once the grace period has passed they are deleted
+	backdateOrphans(t, st, 2*time.Minute)
+	if err := collectGarbage(ctx, cfg, st, logger, m); err != nil {
+		t.Fatalf("collectGarbage failed: %v", err)
+	}
+	stored := exists(t, st, current, old, oldDEK, recent, removed, orphansFile)
+	if stored[old] || stored[oldDEK] || stored[orphansFile] {
+		t.Errorf("Old generation or orphans were not deleted: %v", stored)
+	}
+	if !stored[current] || !stored[recent] || !stored[removed] {
+		t.Errorf("Objects were deleted: %v", stored)
+	}
+
+	// With prune, objects of removed files are kept for the retention
+	cfg.Prune = true
+	if err := collectGarbage(ctx, cfg, st, logger, m); err != nil {
+		t.Fatalf("collectGarbage failed: %v", err)
+	}
+	if orphans := loadOrphans(t, st); len(orphans) != 1 || orphans[removed].IsZero() {
+		t.Errorf("Unexpected orphans %v", orphans)
+	}
+	if !exists(t, st, removed)[removed] {
+		t.Error("Object of removed file was deleted within its retention")
+	}
+
+	backdateOrphans(t, st, 2*time.Hour)
+	if err := collectGarbage(ctx, cfg, st, logger, m); err != nil {
+		t.Fatalf("collectGarbage failed: %v", err)
+	}
+	if stored := exists(t, st, removed, orphansFile, current, recent); stored[removed] || stored[orphansFile] || !stored[current] || !stored[recent] {
+		t.Errorf("Unexpected objects after retention: %v", stored)
+	}
+
+	// Objects of other applications sharing the prefix are never touched
+	if !exists(t, st, foreign)[foreign] {
+		t.Error("Object that doesn't belong to a certificate was deleted")
+	}
+}
+
+func TestCollectGarbageReferencedAgain(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.DiscardHandler)
+	dir := t.TempDir()
+	st := storage.NewFilesystem("test", dir)
+
+	const (
+		first  = "objects/a.example.com.crt/first-A.enc"
+		second = "objects/a.example.com.crt/second-B.enc"
+	)
+	putObject(t, dir, st, first, 2*time.Hour)
+	putObject(t, dir, st, second, 2*time.Hour)
+	cfg := &config.PushConfig{GCGraceSecs: 60}
+
+	m := manifest.New()
+	m.Files["a.example.com.crt"] = manifest.Entry{Object: second}
+	if err := collectGarbage(ctx, cfg, st, logger, m); err != nil {
+		t.Fatalf("collectGarbage failed: %v", err)
+	}
+	if orphans := loadOrphans(t, st); len(orphans) != 1 || orphans[first].IsZero() {
+		t.Fatalf("Unexpected orphans %v", orphans)
+	}
+
+	// A rolled back generation is no longer an orphan
+	backdateOrphans(t, st, 2*time.Minute)
+	m.Files["a.example.com.crt"] = manifest.Entry{Object: first}
+	if err := collectGarbage(ctx, cfg, st, logger, m); err != nil {
+		t.Fatalf("collectGarbage failed: %v", err)
+	}
+	if !exists(t, st, first)[first] {
+		t.Error("Referenced object was deleted")
+	}
+	if orphans := loadOrphans(t, st); len(orphans) != 1 || orphans[second].IsZero() || time.Since(orphans[second]) > time.Minute {
+		t.Errorf("Unexpected orphans %v", orphans)
+	}
+}
+
+// writeCertDir creates files in a new certificate directory
+func writeCertDir(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestPruneLocal(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	m := manifest.New()
+	m.Files["a.example.com.crt"] = manifest.Entry{}
+	files := []string{"a.example.com.crt", "b.example.com.crt", "b.example.com.key", "notes.txt", manifestCacheFile}
+
+	// Removed files are deleted, unrelated files kept
+	cfg := &config.PullConfig{CertDir: writeCertDir(t, files...)}
+	pruned, err := pruneLocal(cfg, logger, m)
+	if err != nil || pruned != 2 {
+		t.Fatalf("pruneLocal returned %d, %v", pruned, err)
+	}
+	entries, _ := os.ReadDir(cfg.CertDir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != strings.Join([]string{manifestCacheFile, "a.example.com.crt", "notes.txt"}, ",") {
+		t.Errorf("Unexpected files after prune: %v", names)
+	}
+
+	// Or moved into the archive
+	cfg = &config.PullConfig{CertDir: writeCertDir(t, files...), PruneArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	pruned, err = pruneLocal(cfg, logger, m)
+	if err != nil || pruned != 2 {
+		t.Fatalf("pruneLocal returned %d, %v", pruned, err)
+	}
+	archived, _ := filepath.Glob(filepath.Join(cfg.PruneArchiveDir, "b.example.com.*.*"))
+	if len(archived) != 2 {
+		t.Errorf("Expected 2 archived files, got %v", archived)
+	}
+	for _, path := range archived {
+		data, err := os.ReadFile(path)
+		if err != nil || !strings.HasPrefix(filepath.Base(path), string(data)+".") {
+			t.Errorf("Archived file %s has content %q, %v", path, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CertDir, "b.example.com.crt")); err == nil {
+		t.Error("Archived file is still in cert_dir")
+	}
+}
+
+func TestPullPrunesOnlyPublishedManifest(t *testing.T) {
+	ctx := context.Background()
+	storageDir := t.TempDir()
+	keyDir := t.TempDir()
+
+	cfg := &config.PullConfig{
+		KeyDir:  keyDir,
+		CertDir: writeCertDir(t, "old.example.com.crt"),
+		Prune:   true,
+		Sources: []config.StorageConfig{{Name: "test", Path: storageDir}},
+	}
+
+	// Without a manifest nothing was published, so nothing is removed
+	if err := config.SaveKey(keyDir, "a.example.com", make([]byte, 32), nil); err != nil {
+		t.Fatalf("SaveKey failed: %v", err)
+	}
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CertDir, "old.example.com.crt")); err != nil {
+		t.Errorf("File was pruned without a manifest: %v", err)
+	}
+
+	// Files missing from a published manifest are removed
+	pusher := newTestPusher(t, "", keyDir)
+	pusher.publish(storage.NewFilesystem("test", storageDir), map[string]string{"a.example.com.crt": "a1"})
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CertDir, "old.example.com.crt")); err == nil {
+		t.Error("Removed file was not pruned")
+	}
+	if data, err := os.ReadFile(filepath.Join(cfg.CertDir, "a.example.com.crt")); err != nil || string(data) != "a1" {
+		t.Errorf("Unexpected pulled file %q, %v", data, err)
+	}
+}
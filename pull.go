@@ -16,64 +16,100 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
+	"sort"
+	"sync"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/atomicfile"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/command"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/crypto"
-	s3client "github.com/digilolnet/digilol-cert-pushpuller/internal/s3"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/keyprovider"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/storage"
 )
 
-func pull(cfg *config.PullConfig) error {
-	ctx := context.Background()
+func pull(ctx context.Context, cfg *config.PullConfig) error {
+	logger := slog.With("mode", "pull")
 
-	// Create S3 client
-	s3Client, err := s3client.NewClient(ctx, &cfg.S3)
+	passphrase, err := cfg.KeyPassphrase.Load()
 	if err != nil {
-		return err
+		return fmt.Errorf("load key passphrase: %w", err)
 	}
 
-	// Download hashes from S3
-	s3Hashes, err := s3client.LoadHashesFromS3(ctx, s3Client, cfg.S3.Bucket, cfg.S3.Prefix)
+	provider, err := keyprovider.New(ctx, &cfg.KeyProvider, cfg.KeyDir, passphrase)
 	if err != nil {
-		return err
+		return fmt.Errorf("create key provider: %w", err)
 	}
 
-	// Read all available keys
-	keyFiles, err := filepath.Glob(filepath.Join(cfg.KeyDir, "*.key"))
-	if err != nil {
-		return fmt.Errorf("list key files: %w", err)
-	}
+	// With local keys there is nothing to decrypt unless key files exist
+	var keyNames []string
+	localKeys := cfg.KeyProvider.Type == "" || cfg.KeyProvider.Type == "local"
+	if localKeys {
+		keyNames, err = config.ListKeys(cfg.KeyDir)
+		if err != nil {
+			return err
+		}
 
-	if len(keyFiles) == 0 {
-		return nil
+		if len(keyNames) == 0 {
+			return nil
+		}
+		slices.Sort(keyNames)
 	}
 
-	// List all .enc files in S3
-	var prefix *string
-	if cfg.S3.Prefix != "" {
-		p := cfg.S3.Prefix + "/"
-		prefix = &p
-	}
+	// Skip everything if the manifest is unchanged since the last
+	// successful run with the same keys from the same source
+	cachePath := filepath.Join(cfg.CertDir, manifestCacheFile)
+	cache := loadManifestCache(cachePath)
 
-	listOutput, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: &cfg.S3.Bucket,
-		Prefix: prefix,
-	})
-	if err != nil {
-		return fmt.Errorf("list S3 objects: %w", err)
-	}
+	// Download the manifest from the first source that is available
+	var (
+		st        storage.Storage
+		published *manifest.Manifest
+		etag      string
+		errs      []error
+	)
+	sources := cfg.Storages()
+	for i, sourceCfg := range sources {
+		var cachedETag string
+		if cache.Source == sourceCfg.Name && slices.Equal(cache.Keys, keyNames) {
+			cachedETag = cache.ETag
+		}
 
-	if len(listOutput.Contents) == 0 {
-		return nil
+		source, err := storage.New(ctx, &sourceCfg)
+		if err == nil {
+			published, etag, err = storage.LoadManifest(ctx, source, cachedETag)
+		}
+		if errors.Is(err, storage.ErrNotModified) {
+			runMetrics.ObserveStorage("pull", sourceCfg.Name, nil)
+			runStatus.StorageUsed(sourceCfg.Name, nil)
+			logger.Debug("manifest unchanged", "storage", sourceCfg.Name, "etag", etag)
+			return nil
+		}
+
+		runMetrics.ObserveStorage("pull", sourceCfg.Name, err)
+		runStatus.StorageUsed(sourceCfg.Name, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sourceCfg.Name, err))
+			if i < len(sources)-1 {
+				logger.Warn("failed to load manifest, trying next source", "storage", sourceCfg.Name, "error", err)
+			}
+			continue
+		}
+
+		st = source
+		logger = logger.With("storage", sourceCfg.Name)
+		break
+	}
+	if st == nil {
+		return errors.Join(errs...)
 	}
 
 	// Create certificate directory
@@ -81,75 +117,245 @@ func pull(cfg *config.PullConfig) error {
 		return fmt.Errorf("create certificate directory %s: %w", cfg.CertDir, err)
 	}
 
-	// Download and decrypt each .enc file
-	for _, obj := range listOutput.Contents {
-		fileName := filepath.Base(*obj.Key)
-
-		// Skip non-.enc files
-		if !strings.HasSuffix(fileName, ".enc") {
-			continue
-		}
-
-		// Extract cert name from filename (e.g., _.domain.com from _.domain.com.crt.enc)
-		nameWithoutEnc := strings.TrimSuffix(fileName, ".enc")
-		certName, ok := config.ExtractCertName(nameWithoutEnc)
+	// Group files by certificate name
+	certFiles := make(map[string][]string)
+	for fileName := range published.Files {
+		certName, ok := config.ExtractCertName(fileName)
 		if !ok {
 			continue
 		}
+		certFiles[certName] = append(certFiles[certName], fileName)
+	}
 
-		// Check if we have the key for this certificate
-		key, err := config.LoadKey(cfg.KeyDir, certName)
-		if err != nil {
-			continue
-		}
+	certNames := make([]string, 0, len(certFiles))
+	for certName, files := range certFiles {
+		certNames = append(certNames, certName)
+		sort.Strings(files)
+	}
+	sort.Strings(certNames)
 
-		// Check if local file exists and compare hash with S3 hashes
-		filePath := filepath.Join(cfg.CertDir, nameWithoutEnc)
-		if localData, err := os.ReadFile(filePath); err == nil {
-			localHash := sha256.Sum256(localData)
-			localHashStr := hex.EncodeToString(localHash[:])
+	// pullFile brings the local copy of one file up to date with the
+	// object the manifest points at
+	pullFile := func(certName, fileName string) (fileOutcome, error) {
+		entry := published.Files[fileName]
 
-			// Compare with hash from S3 .hashes.json
-			if s3Hash, ok := s3Hashes[nameWithoutEnc]; ok && s3Hash == localHashStr {
-				continue
+		// Check if local file exists and compare hash with the manifest
+		filePath := filepath.Join(cfg.CertDir, fileName)
+		if localHashStr, _, err := hashFile(filePath); err == nil && localHashStr == entry.SHA256 {
+			return outcomeUnchanged, nil
+		}
+
+		// Fetch the wrapped data key if the object has one
+		var wrappedKey []byte
+		if entry.DEK {
+			var err error
+			wrappedKey, err = storage.Download(ctx, st, entry.Object+".dek")
+			if err != nil {
+				return outcomeFailed, err
 			}
 		}
 
-		// Get object from S3
-		getOutput, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: &cfg.S3.Bucket,
-			Key:    obj.Key,
-		})
+		// Check if we have the key for this certificate
+		key, err := provider.DecryptDataKey(ctx, certName, wrappedKey)
+		if errors.Is(err, keyprovider.ErrNoKey) {
+			return outcomeSkippedNoKey, nil
+		}
 		if err != nil {
-			return fmt.Errorf("download %s from S3: %w", *obj.Key, err)
+			return outcomeFailed, err
 		}
 
-		encryptedData, err := io.ReadAll(getOutput.Body)
-		getOutput.Body.Close()
+		// Download, decrypt and write to local file
+		encSize, err := downloadFile(ctx, st, entry.Object, filePath, key)
 		if err != nil {
-			return fmt.Errorf("read %s: %w", *obj.Key, err)
+			return outcomeFailed, err
+		}
+
+		runMetrics.FileDownloaded(encSize)
+		runStatus.FileChanged(fileName)
+		logger.Info("downloaded", "cert", certName, "file", fileName, "s3_key", storage.LogKey(st, entry.Object), "bytes", encSize)
+		return outcomeUpdated, nil
+	}
+
+	// Download and decrypt certificates concurrently; files of one
+	// certificate are handled in order since they share its key. A failed
+	// file doesn't stop the others from being updated.
+	summary := &pullSummary{}
+	forEachLimit(cfg.Concurrency, certNames, func(certName string) error {
+		for _, fileName := range certFiles[certName] {
+			outcome, err := pullFile(certName, fileName)
+			if err != nil {
+				logger.Error("failed to pull file", "cert", certName, "file", fileName, "error", err)
+			}
+			summary.record(outcome, err)
 		}
+		return nil
+	})
 
-		// Decrypt the data
-		decrypted, err := crypto.DecryptData(encryptedData, key)
+	// Remove certificates that were removed on the push side, but only
+	// if a manifest was actually published
+	if cfg.Prune && (etag != "" || len(published.Files) > 0) {
+		pruned, err := pruneLocal(cfg, logger, published)
+		summary.pruned = pruned
 		if err != nil {
-			return fmt.Errorf("decrypt %s: %w", *obj.Key, err)
+			summary.record(outcomeFailed, err)
+			logger.Error("failed to prune certificate files", "error", err)
 		}
+	}
 
-		// Write to local file (without .enc extension)
-		if err := os.WriteFile(filePath, decrypted, 0600); err != nil {
-			return fmt.Errorf("write %s: %w", filePath, err)
+	logger.Info("pull summary", "updated", summary.updated, "unchanged", summary.unchanged, "skipped_no_key", summary.skippedNoKey, "pruned", summary.pruned, "failed", len(summary.failed))
+
+	// Run reload command if specified, after failures only if something
+	// was updated
+	if cfg.ReloadCmd != "" && (len(summary.failed) == 0 || summary.updated+summary.pruned > 0) {
+		opts := commandOptions(cfg.Reload.TimeoutSecs, cfg.Reload.Retries, cfg.Reload.RetryDelaySecs)
+		if err := command.RunCommandWithRetries(ctx, logger.With("command", "reload"), cfg.ReloadCmd, nil, opts); err != nil {
+			return fmt.Errorf("run reload command: %w", err)
 		}
+	}
 
-		log.Printf("downloaded %s", nameWithoutEnc)
+	if err := summary.err(); err != nil {
+		return err
 	}
 
-	// Run reload command if specified
-	if cfg.ReloadCmd != "" {
-		if err := command.RunCommandWithEnv(cfg.ReloadCmd, nil); err != nil {
-			return fmt.Errorf("run reload command: %w", err)
+	// Remember the manifest only once everything in it has been handled.
+	// The cache doesn't track which keys a remote provider grants, so
+	// skipped files must be tried again once access changes.
+	if etag != "" && (localKeys || summary.skippedNoKey == 0) {
+		cache := manifestCache{Source: st.Name(), ETag: etag, Keys: keyNames}
+		if err := cache.save(cachePath); err != nil {
+			logger.Warn("failed to save manifest cache", "path", cachePath, "error", err)
 		}
 	}
 
 	return nil
 }
+
+// manifestCacheFile stores the ETag of the manifest in the certificate
+// directory after a successful pull
+const manifestCacheFile = ".pushpuller-manifest.json"
+
+// manifestCache is the state of the last successful pull. Keys are the
+// local key names at the time, so new keys force a full pull. Source is
+// the name of the storage the manifest was read from, as ETags differ
+// between storages.
+type manifestCache struct {
+	Source string   `json:"source,omitempty"`
+	ETag   string   `json:"etag"`
+	Keys   []string `json:"keys,omitempty"`
+}
+
+// loadManifestCache reads the manifest cache at path. A missing or broken
+// cache results in an empty one, which forces a full pull.
+func loadManifestCache(path string) manifestCache {
+	var cache manifestCache
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+
+	// Older versions only read from the [s3] table
+	if cache.Source == "" {
+		cache.Source = "s3"
+	}
+	return cache
+}
+
+// save writes the cache to path
+func (c manifestCache) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal manifest cache: %w", err)
+	}
+
+	return atomicfile.Write(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// downloadFile streams the object at objectKey through decryption into
+// filePath, replacing it only once the whole object has been verified.
+// Returns the number of bytes downloaded.
+func downloadFile(ctx context.Context, st storage.Storage, objectKey, filePath string, key []byte) (int64, error) {
+	body, err := st.Get(ctx, objectKey)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	counter := &countingReader{r: body}
+	err = atomicfile.Write(filePath, 0600, func(w io.Writer) error {
+		if _, err := crypto.DecryptStream(w, counter, key); err != nil {
+			return fmt.Errorf("decrypt %s: %w", objectKey, err)
+		}
+		return nil
+	})
+	return counter.n, err
+}
+
+// fileOutcome is the result of pulling one file
+type fileOutcome int
+
+const (
+	outcomeUpdated fileOutcome = iota
+	outcomeUnchanged
+	outcomeSkippedNoKey
+	outcomeFailed
+)
+
+// pullSummary counts the outcomes of the files of a pull
+type pullSummary struct {
+	mu           sync.Mutex
+	updated      int
+	unchanged    int
+	skippedNoKey int
+	pruned       int
+	failed       []error
+}
+
+// record adds the outcome of one file
+func (s *pullSummary) record(outcome fileOutcome, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch outcome {
+	case outcomeUpdated:
+		s.updated++
+	case outcomeUnchanged:
+		s.unchanged++
+	case outcomeSkippedNoKey:
+		s.skippedNoKey++
+	case outcomeFailed:
+		s.failed = append(s.failed, err)
+	}
+}
+
+// err returns nil if no file failed, a partialFailureError if other files
+// were updated or already up to date and a plain error otherwise. Files
+// skipped for lack of a key are not the client's, so they count neither
+// way: a client whose every own file failed has failed entirely.
+func (s *pullSummary) err() error {
+	if len(s.failed) == 0 {
+		return nil
+	}
+
+	ok := s.updated + s.unchanged
+	err := fmt.Errorf("%d of %d files failed: %w", len(s.failed), ok+len(s.failed), errors.Join(s.failed...))
+	if ok == 0 {
+		return err
+	}
+	return &partialFailureError{err: err}
+}
+
+// partialFailureError is returned by pull when some files failed while
+// others are up to date
+type partialFailureError struct {
+	err error
+}
+
+func (e *partialFailureError) Error() string {
+	return "partial failure: " + e.err.Error()
+}
+
+func (e *partialFailureError) Unwrap() error {
+	return e.err
+}
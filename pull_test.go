@@ -0,0 +1,210 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/keyprovider"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/storage"
+)
+
+func TestPullSummaryExitCode(t *testing.T) {
+	errFailed := errors.New("corrupt object")
+
+	for _, tc := range []struct {
+		name     string
+		outcomes []fileOutcome
+		exitCode int
+	}{
+		{"nothing to pull", nil, 0},
+		{"all ok", []fileOutcome{outcomeUpdated, outcomeUnchanged, outcomeSkippedNoKey}, 0},
+		{"updated and failed", []fileOutcome{outcomeUpdated, outcomeFailed}, exitPartialFailure},
+		{"unchanged and failed", []fileOutcome{outcomeUnchanged, outcomeFailed}, exitPartialFailure},
+		{"all failed", []fileOutcome{outcomeFailed, outcomeFailed}, exitFailure},
+		{"skipped and failed", []fileOutcome{outcomeSkippedNoKey, outcomeSkippedNoKey, outcomeFailed}, exitFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			summary := &pullSummary{}
+			for _, outcome := range tc.outcomes {
+				var err error
+				if outcome == outcomeFailed {
+					err = errFailed
+				}
+				summary.record(outcome, err)
+			}
+
+			err := summary.err()
+			if tc.exitCode == 0 {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errFailed) {
+				t.Errorf("Expected error wrapping the file errors, got %v", err)
+			}
+			if code := pullExitCode(err); code != tc.exitCode {
+				t.Errorf("Expected exit code %d, got %d for %v", tc.exitCode, code, err)
+			}
+		})
+	}
+}
+
+func TestPullManifestCache(t *testing.T) {
+	ctx := context.Background()
+	storageDir := t.TempDir()
+	keyDir := t.TempDir()
+
+	pusher := newTestPusher(t, "", keyDir)
+	pusher.publish(storage.NewFilesystem("test", storageDir), map[string]string{
+		"a.example.com.crt": "a1",
+		"b.example.com.crt": "b1",
+	})
+
+	// The puller only has the key of one certificate at first
+	pullKeyDir := t.TempDir()
+	copyKey(t, keyDir, pullKeyDir, "a.example.com")
+	cfg := &config.PullConfig{
+		KeyDir:  pullKeyDir,
+		CertDir: t.TempDir(),
+		Sources: []config.StorageConfig{{Name: "test", Path: storageDir}},
+	}
+
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	checkPulled(t, cfg.CertDir, "a.example.com.crt", "a1")
+
+	// An unchanged manifest skips the run, so a removed file stays missing
+	os.Remove(filepath.Join(cfg.CertDir, "a.example.com.crt"))
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CertDir, "a.example.com.crt")); err == nil {
+		t.Error("Unchanged manifest was pulled again")
+	}
+
+	// A new key invalidates the cache
+	copyKey(t, keyDir, pullKeyDir, "b.example.com")
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	checkPulled(t, cfg.CertDir, "a.example.com.crt", "a1")
+	checkPulled(t, cfg.CertDir, "b.example.com.crt", "b1")
+}
+
+// copyKey copies the key file of certName
+func copyKey(t *testing.T, from, to, certName string) {
+	t.Helper()
+	key, err := config.LoadKey(from, certName, nil)
+	if err == nil {
+		err = config.SaveKey(to, certName, key, nil)
+	}
+	if err != nil {
+		t.Fatalf("Failed to copy key of %s: %v", certName, err)
+	}
+}
+
+// checkPulled checks the content of a pulled file
+func checkPulled(t *testing.T, certDir, fileName, want string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(certDir, fileName))
+	if err != nil || string(data) != want {
+		t.Errorf("%s: expected %q, got %q, %v", fileName, want, data, err)
+	}
+}
+
+// fakeKMS implements GenerateDataKey and Decrypt by "wrapping" keys with a
+// fixed prefix. Decrypt is denied while deny is set.
+func fakeKMS(t *testing.T, deny *atomic.Bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CiphertextBlob []byte
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			key := bytes.Repeat([]byte{7}, 32)
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": "test", "Plaintext": key, "CiphertextBlob": append([]byte("wrapped:"), key...)})
+		case "TrentService.Decrypt":
+			if deny.Load() {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"__type": "AccessDeniedException", "message": "denied"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": "test", "Plaintext": bytes.TrimPrefix(req.CiphertextBlob, []byte("wrapped:"))})
+		default:
+			t.Errorf("Unexpected request %s", r.Header.Get("X-Amz-Target"))
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+}
+
+func TestPullRemoteProviderSkipsAreNotCached(t *testing.T) {
+	ctx := context.Background()
+	var deny atomic.Bool
+	server := fakeKMS(t, &deny)
+	defer server.Close()
+
+	kmsCfg := config.AWSKMSConfig{KeyID: "test", Region: "us-east-1", Endpoint: server.URL, AccessKey: "test", SecretKey: "test"}
+	provider, err := keyprovider.NewAWSKMS(ctx, &kmsCfg)
+	if err != nil {
+		t.Fatalf("NewAWSKMS failed: %v", err)
+	}
+
+	storageDir := t.TempDir()
+	pusher := newTestPusher(t, "", t.TempDir())
+	pusher.provider = provider
+	pusher.publish(storage.NewFilesystem("test", storageDir), map[string]string{"a.example.com.crt": "a1"})
+
+	cfg := &config.PullConfig{
+		CertDir:     t.TempDir(),
+		KeyProvider: config.KeyProviderConfig{Type: "awskms", AWSKMS: kmsCfg},
+		Sources:     []config.StorageConfig{{Name: "test", Path: storageDir}},
+	}
+
+	// Denied files are skipped without remembering the manifest
+	deny.Store(true)
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CertDir, manifestCacheFile)); err == nil {
+		t.Error("Manifest was cached although files were skipped")
+	}
+
+	// Once access is granted the unchanged manifest is pulled
+	deny.Store(false)
+	if err := pull(ctx, cfg); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	checkPulled(t, cfg.CertDir, "a.example.com.crt", "a1")
+	if data, err := os.ReadFile(filepath.Join(cfg.CertDir, manifestCacheFile)); err != nil || !strings.Contains(string(data), "etag") {
+		t.Errorf("Manifest was not cached after a complete pull: %q, %v", data, err)
+	}
+}
@@ -20,45 +20,99 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/command"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
 	"github.com/digilolnet/digilol-cert-pushpuller/internal/crypto"
-	s3client "github.com/digilolnet/digilol-cert-pushpuller/internal/s3"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/keyprovider"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/storage"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/trigger"
 )
 
-func push(cfg *config.PushConfig) error {
-	ctx := context.Background()
+// defaultNotifyTimeout limits each call to a pull daemon trigger endpoint
+const defaultNotifyTimeout = 10 * time.Second
+
+// maxPublishAttempts limits how often publishing the manifest is retried
+// when other pushers keep replacing it
+const maxPublishAttempts = 5
+
+// maxUploadAttempts limits how often a file that changes while it is
+// uploaded is uploaded again
+const maxUploadAttempts = 3
+
+// errFileChanged is returned when a file no longer has the content it was
+// hashed with before the upload
+var errFileChanged = errors.New("file changed while uploading")
+
+func push(ctx context.Context, cfg *config.PushConfig) error {
+	logger := slog.With("mode", "push")
 
 	// Run all lego commands if configured
 	for i, legoCmd := range cfg.LegoCommands {
-		if err := command.RunCommandWithEnv(legoCmd.Command, legoCmd.Env); err != nil {
-			log.Printf("lego command %d/%d failed: %v", i+1, len(cfg.LegoCommands), err)
+		cmdLogger := logger.With("command", fmt.Sprintf("lego %d/%d", i+1, len(cfg.LegoCommands)))
+		opts := commandOptions(legoCmd.TimeoutSecs, legoCmd.Retries, legoCmd.RetryDelaySecs)
+		err := command.RunCommandWithRetries(ctx, cmdLogger, legoCmd.Command, legoCmd.Env, opts)
+		runMetrics.SetLegoExitCode(i+1, command.ExitCode(err))
+		if err != nil {
+			cmdLogger.Error("lego command failed", "error", err)
 			// Continue anyway to try other commands and push existing certs
 		}
 	}
 
-	// Create S3 client
-	s3Client, err := s3client.NewClient(ctx, &cfg.S3)
-	if err != nil {
+	if _, err := uploadCertificates(ctx, cfg, logger); err != nil {
 		return err
 	}
 
-	// Download existing hashes from S3
-	existingHashes, err := s3client.LoadHashesFromS3(ctx, s3Client, cfg.S3.Bucket, cfg.S3.Prefix)
+	return runPushReload(ctx, cfg, logger)
+}
+
+// pushChanges uploads changed certificates without running lego commands
+// and runs the reload command if anything was uploaded
+func pushChanges(ctx context.Context, cfg *config.PushConfig) error {
+	logger := slog.With("mode", "push")
+
+	uploaded, err := uploadCertificates(ctx, cfg, logger)
 	if err != nil {
 		return err
 	}
+	if uploaded == 0 {
+		return nil
+	}
+
+	return runPushReload(ctx, cfg, logger)
+}
+
+// uploadCertificates encrypts and uploads certificate files whose hash
+// differs from the manifest to every storage, then updates their manifests.
+// Returns the number of files uploaded.
+func uploadCertificates(ctx context.Context, cfg *config.PushConfig, logger *slog.Logger) (int, error) {
+	passphrase, err := cfg.KeyPassphrase.Load()
+	if err != nil {
+		return 0, fmt.Errorf("load key passphrase: %w", err)
+	}
+
+	provider, err := keyprovider.New(ctx, &cfg.KeyProvider, cfg.KeyDir, passphrase)
+	if err != nil {
+		return 0, fmt.Errorf("create key provider: %w", err)
+	}
 
 	// Find all certificate files
 	entries, err := os.ReadDir(cfg.CertDir)
 	if err != nil {
-		return fmt.Errorf("read certificate directory %s: %w", cfg.CertDir, err)
+		return 0, fmt.Errorf("read certificate directory %s: %w", cfg.CertDir, err)
 	}
 
 	// Group files by certificate name (e.g., _.domain.com)
@@ -69,106 +123,390 @@ func push(cfg *config.PushConfig) error {
 			continue
 		}
 
+		// Pullers reject manifests with hidden or otherwise unsafe names
 		name := entry.Name()
 		certName, ok := config.ExtractCertName(name)
-		if !ok {
+		if !ok || manifest.ValidFileName(name) != nil {
 			continue
 		}
 
 		certFiles[certName] = append(certFiles[certName], name)
 	}
 
-	newHashes := make(map[string]string)
+	// Publish to every storage; one being unavailable doesn't keep the
+	// others from being updated
+	var (
+		changed   = make(map[string]bool)
+		published []config.StorageConfig
+		errs      []error
+	)
+	for _, storageCfg := range cfg.Storages() {
+		storageLogger := logger.With("storage", storageCfg.Name)
+		var (
+			uploaded   []string
+			didPublish bool
+		)
+		st, err := storage.New(ctx, &storageCfg)
+		if err == nil {
+			uploaded, didPublish, err = publishCertificates(ctx, cfg, st, provider, storageLogger, certFiles)
+		}
+		runMetrics.ObserveStorage("push", storageCfg.Name, err)
+		runStatus.StorageUsed(storageCfg.Name, err)
+		if err != nil {
+			storageLogger.Error("failed to publish certificates", "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", storageCfg.Name, err))
+		}
+
+		if didPublish {
+			published = append(published, storageCfg)
+		}
+		for _, fileName := range uploaded {
+			changed[fileName] = true
+		}
+	}
+
+	changedFiles := slices.Sorted(maps.Keys(changed))
+	for _, fileName := range changedFiles {
+		runStatus.FileChanged(fileName)
+	}
+
+	if len(published) > 0 {
+		notifyPullers(ctx, cfg, logger, published, changedFiles)
+	}
+
+	return len(changedFiles), errors.Join(errs...)
+}
+
+// publishCertificates uploads the changed certificate files to one storage
+// and replaces its manifest. Returns the files uploaded and whether the
+// manifest was replaced.
+func publishCertificates(ctx context.Context, cfg *config.PushConfig, st storage.Storage, provider keyprovider.KeyProvider, logger *slog.Logger, certFiles map[string][]string) ([]string, bool, error) {
+	// Download the current manifest
+	published, etag, err := storage.LoadManifest(ctx, st, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	// An empty or unmounted cert_dir would otherwise unpublish, and with
+	// prune delete, every certificate of this pusher
+	if len(certFiles) == 0 && ownsFiles(published, cfg.PusherID) {
+		return nil, false, fmt.Errorf("no certificates in %s, refusing to unpublish all certificates", cfg.CertDir)
+	}
+
+	// Objects uploaded by earlier attempts, reused while the file is unchanged
+	staged := make(map[string]manifest.Entry)
 
-	// Process each certificate
-	for certName, files := range certFiles {
-		// Get or create encryption key for this certificate
-		key, err := config.GetOrCreateKey(cfg.KeyDir, certName)
+	// The manifest is only replaced if no other pusher replaced it since it
+	// was loaded. Otherwise the changes are applied again on top of the new
+	// manifest.
+	var (
+		uploaded   []string
+		didPublish bool
+	)
+	for attempt := 1; ; attempt++ {
+		next, err := stageCertificates(ctx, cfg, provider, st, logger, certFiles, published, staged)
 		if err != nil {
-			return fmt.Errorf("get encryption key for %s: %w", certName, err)
+			return nil, false, err
 		}
 
-		for _, fileName := range files {
-			filePath := filepath.Join(cfg.CertDir, fileName)
-			data, err := os.ReadFile(filePath)
+		uploaded = uploaded[:0]
+		for fileName, entry := range next.Files {
+			if entry != published.Files[fileName] && entry == staged[fileName] {
+				uploaded = append(uploaded, fileName)
+			}
+		}
+		sort.Strings(uploaded)
+
+		if next.Equal(published) {
+			break
+		}
+
+		// Publish the new generation by replacing the manifest
+		newETag, err := storage.PutManifest(ctx, st, next, etag)
+		if errors.Is(err, storage.ErrConflict) && attempt < maxPublishAttempts {
+			logger.Warn("manifest changed concurrently, retrying", "attempt", attempt)
+			published, etag, err = storage.LoadManifest(ctx, st, "")
 			if err != nil {
-				log.Printf("failed to read %s: %v", filePath, err)
-				continue
+				return nil, false, err
 			}
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("publish manifest: %w", err)
+		}
 
-			// Calculate SHA256 of unencrypted file
-			localHash := sha256.Sum256(data)
-			localHashStr := hex.EncodeToString(localHash[:])
+		logger.Info("published manifest", "etag", newETag, "files", len(next.Files))
+		published = next
+		didPublish = true
+		break
+	}
+
+	// Delete old generations and, with prune, objects of removed
+	// certificates once the manifest no longer refers to them
+	if err := collectGarbage(ctx, cfg, st, logger, published); err != nil {
+		logger.Error("failed to delete unreferenced objects", "error", err)
+	}
 
-			// Build S3 key with .enc extension
-			s3FileName := fileName + ".enc"
-			s3Key := s3client.BuildKey(cfg.S3.Prefix, s3FileName)
+	return uploaded, didPublish, nil
+}
 
-			newHashes[fileName] = localHashStr
+// ownsFiles reports whether any entry of m is owned by the pusher
+func ownsFiles(m *manifest.Manifest, pusherID string) bool {
+	for _, entry := range m.Files {
+		if entry.OwnedBy(pusherID) {
+			return true
+		}
+	}
+	return false
+}
+
+// stageCertificates uploads new generations of the files in certFiles that
+// differ from the published manifest and returns the manifest referring to
+// them. Entries owned by other pushers are kept as published. Uploaded
+// objects are recorded in staged so a repeated call doesn't upload them
+// again.
+func stageCertificates(ctx context.Context, cfg *config.PushConfig, provider keyprovider.KeyProvider, st storage.Storage, logger *slog.Logger, certFiles map[string][]string, published *manifest.Manifest, staged map[string]manifest.Entry) (*manifest.Manifest, error) {
+	certNames := make([]string, 0, len(certFiles))
+	for certName := range certFiles {
+		certNames = append(certNames, certName)
+	}
+	sort.Strings(certNames)
+
+	var (
+		mu   sync.Mutex
+		next = manifest.New()
+	)
+
+	// Entries of other pushers are published unchanged
+	for fileName, entry := range published.Files {
+		if !entry.OwnedBy(cfg.PusherID) {
+			next.Files[fileName] = entry
+		}
+	}
+
+	// Process certificates concurrently; files of one certificate share its
+	// key and are handled in order so the key is only created once
+	err := forEachLimit(cfg.Concurrency, certNames, func(certName string) error {
+		for _, fileName := range certFiles[certName] {
+			filePath := filepath.Join(cfg.CertDir, fileName)
+			current, isPublished := published.Files[fileName]
+			if isPublished && !current.Claimable(cfg.PusherID) {
+				logger.Warn("skipping certificate file owned by another pusher", "cert", certName, "file", fileName, "owner", current.Owner)
+				continue
+			}
+			current.Owner = cfg.PusherID
+
+			// Calculate SHA256 of unencrypted file
+			localHashStr, size, err := hashFile(filePath)
+			if err != nil {
+				// Keep the published generation rather than unpublishing it
+				logger.Warn("failed to read certificate file", "cert", certName, "path", filePath, "error", err)
+				if isPublished {
+					mu.Lock()
+					next.Files[fileName] = published.Files[fileName]
+					mu.Unlock()
+				}
+				continue
+			}
 
 			// Check if hash matches
-			if existingHash, ok := existingHashes[fileName]; ok && existingHash == localHashStr {
+			if isPublished && current.SHA256 == localHashStr {
+				mu.Lock()
+				next.Files[fileName] = current
+				mu.Unlock()
+				continue
+			}
+
+			// Reuse the object of an earlier attempt
+			mu.Lock()
+			entry, isStaged := staged[fileName]
+			mu.Unlock()
+			if isStaged && entry.SHA256 == localHashStr {
+				mu.Lock()
+				next.Files[fileName] = entry
+				mu.Unlock()
 				continue
 			}
 
-			// Encrypt the certificate data
-			encrypted, err := crypto.EncryptData(data, key)
+			// Get the data key for this object
+			key, wrappedKey, err := provider.GenerateDataKey(ctx, certName)
 			if err != nil {
-				return fmt.Errorf("encrypt %s: %w", filePath, err)
+				return fmt.Errorf("get encryption key for %s: %w", certName, err)
 			}
 
-			// Upload to S3
-			_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-				Bucket: &cfg.S3.Bucket,
-				Key:    &s3Key,
-				Body:   bytes.NewReader(encrypted),
-			})
+			// Encrypt and upload the certificate data. The file may have
+			// been replaced since it was hashed, e.g. in watch mode.
+			objectKey, localHashStr, encSize, err := uploadGeneration(ctx, st, logger, fileName, filePath, localHashStr, size, key)
 			if err != nil {
-				return fmt.Errorf("upload %s to S3: %w", s3Key, err)
+				return err
 			}
 
-			log.Printf("uploaded %s", s3Key)
+			// Store the wrapped data key next to the object
+			if wrappedKey != nil {
+				err = st.Put(ctx, objectKey+".dek", bytes.NewReader(wrappedKey), int64(len(wrappedKey)))
+				if err != nil {
+					return err
+				}
+			}
+
+			runMetrics.FileUploaded(encSize)
+			entry = manifest.Entry{SHA256: localHashStr, Object: objectKey, DEK: wrappedKey != nil, Owner: cfg.PusherID}
+			mu.Lock()
+			next.Files[fileName] = entry
+			staged[fileName] = entry
+			mu.Unlock()
+			logger.Info("uploaded", "cert", certName, "s3_key", storage.LogKey(st, objectKey), "bytes", encSize)
 		}
+		return nil
+	})
+
+	// The manifest must only refer to objects that were all uploaded
+	if err != nil {
+		return nil, err
 	}
+	return next, nil
+}
 
-	// Check if hashes changed
-	hashesChanged := false
-	if len(newHashes) != len(existingHashes) {
-		hashesChanged = true
-	} else {
-		for k, v := range newHashes {
-			if existingHashes[k] != v {
-				hashesChanged = true
-				break
-			}
+// notifiedStorage describes a storage whose manifest changed in
+// notifications
+type notifiedStorage struct {
+	Name   string `json:"name"`
+	Bucket string `json:"bucket,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// notifyPullers calls the trigger endpoints of pull daemons after the
+// manifests of the published storages changed. Failures are only logged
+// since pullers still catch up on their schedule.
+func notifyPullers(ctx context.Context, cfg *config.PushConfig, logger *slog.Logger, published []config.StorageConfig, changed []string) {
+	if len(cfg.Notify) == 0 {
+		return
+	}
+
+	storages := make([]notifiedStorage, 0, len(published))
+	for _, s := range published {
+		n := notifiedStorage{Name: s.Name, Path: s.Path}
+		if s.Path == "" {
+			n.Bucket, n.Prefix = s.S3.Bucket, s.S3.Prefix
 		}
+		storages = append(storages, n)
 	}
 
-	// Upload updated hashes file if it changed
-	if hashesChanged {
-		hashesJSON, err := json.Marshal(newHashes)
+	body, err := json.Marshal(struct {
+		Storages []notifiedStorage `json:"storages"`
+		Files    []string          `json:"files"`
+	}{storages, changed})
+	if err != nil {
+		logger.Error("failed to marshal notification", "error", err)
+		return
+	}
+
+	for _, n := range cfg.Notify {
+		secret, err := n.Secret.Load()
 		if err != nil {
-			return fmt.Errorf("marshal hashes: %w", err)
+			logger.Error("failed to load notify secret", "url", n.URL, "error", err)
+			continue
+		}
+
+		timeout := time.Duration(n.TimeoutSecs) * time.Second
+		if timeout <= 0 {
+			timeout = defaultNotifyTimeout
 		}
-		hashesJSON = append(hashesJSON, '\n')
 
-		hashesKey := s3client.BuildKey(cfg.S3.Prefix, ".hashes.json")
-		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-			Bucket: &cfg.S3.Bucket,
-			Key:    &hashesKey,
-			Body:   bytes.NewReader(hashesJSON),
-		})
+		notifyCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = trigger.Notify(notifyCtx, http.DefaultClient, n.URL, secret, body)
+		cancel()
 		if err != nil {
-			log.Printf("failed to upload hashes file: %v", err)
+			logger.Warn("failed to notify puller", "url", n.URL, "error", err)
+			continue
 		}
+		logger.Info("notified puller", "url", n.URL)
 	}
+}
 
-	// Run reload command if specified
-	if cfg.ReloadCmd != "" {
-		if err := command.RunCommandWithEnv(cfg.ReloadCmd, nil); err != nil {
-			return fmt.Errorf("run reload command: %w", err)
-		}
+// runPushReload runs the reload command if one is configured
+func runPushReload(ctx context.Context, cfg *config.PushConfig, logger *slog.Logger) error {
+	if cfg.ReloadCmd == "" {
+		return nil
 	}
 
+	opts := commandOptions(cfg.Reload.TimeoutSecs, cfg.Reload.Retries, cfg.Reload.RetryDelaySecs)
+	if err := command.RunCommandWithRetries(ctx, logger.With("command", "reload"), cfg.ReloadCmd, nil, opts); err != nil {
+		return fmt.Errorf("run reload command: %w", err)
+	}
 	return nil
 }
+
+// uploadGeneration uploads a new generation of fileName from the file at
+// filePath, which had the given hash and size when it was checked. If the
+// uploaded content turns out to differ, the object is deleted and the file
+// uploaded again. Returns the object key, the hash of the uploaded content
+// and the number of bytes uploaded.
+func uploadGeneration(ctx context.Context, st storage.Storage, logger *slog.Logger, fileName, filePath, hash string, size int64, key []byte) (string, string, int64, error) {
+	for attempt := 1; ; attempt++ {
+		// Each version gets its own object, so pullers reading the
+		// current manifest never see it change underneath them
+		objectKey := manifest.NewObjectKey(fileName, hash)
+
+		encSize, err := uploadFile(ctx, st, objectKey, filePath, hash, size, key)
+		if !errors.Is(err, errFileChanged) {
+			return objectKey, hash, encSize, err
+		}
+
+		// Don't leave an object behind whose content doesn't match its hash
+		if err := st.Delete(ctx, objectKey); err != nil {
+			return "", "", 0, fmt.Errorf("delete %s: %w", objectKey, err)
+		}
+		if attempt == maxUploadAttempts {
+			return "", "", 0, fmt.Errorf("upload %s: %w", filePath, err)
+		}
+		logger.Warn("file changed while uploading, retrying", "file", fileName, "attempt", attempt)
+
+		hash, size, err = hashFile(filePath)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("hash %s: %w", filePath, err)
+		}
+	}
+}
+
+// uploadFile streams the file at filePath through encryption to the object
+// at objectKey and returns the number of bytes uploaded. The content is
+// hashed in the same pass; errFileChanged is returned if it doesn't match
+// hash and size.
+func uploadFile(ctx context.Context, st storage.Storage, objectKey, filePath, hash string, size int64, key []byte) (int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("open %s: %w", filePath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	plain := &countingReader{r: io.TeeReader(io.LimitReader(f, size), h)}
+	encReader, err := crypto.EncryptReader(plain, key)
+	if err != nil {
+		return 0, fmt.Errorf("encrypt %s: %w", filePath, err)
+	}
+
+	encSize, err := crypto.EncryptedSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("encrypt %s: %w", filePath, err)
+	}
+
+	err = st.Put(ctx, objectKey, encReader, encSize)
+
+	// A file that shrank can't fill the announced size
+	if err != nil && plain.n < size {
+		if fi, statErr := f.Stat(); statErr == nil && fi.Size() < size {
+			return 0, errFileChanged
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if plain.n != size || hex.EncodeToString(h.Sum(nil)) != hash {
+		return 0, errFileChanged
+	}
+	return encSize, nil
+}
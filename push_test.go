@@ -0,0 +1,333 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/crypto"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/keyprovider"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/manifest"
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/storage"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadGenerationFileChanged(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.DiscardHandler)
+	key := bytes.Repeat([]byte{1}, 32)
+	filePath := filepath.Join(t.TempDir(), "a.example.com.crt")
+
+	for _, tc := range []struct {
+		name   string
+		hashed string
+	}{
+		{"same size", "old"},
+		{"shrank", "older content"},
+		{"grew", "o"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := storage.NewFilesystem("test", t.TempDir())
+
+			// The file was replaced after it was hashed
+			if err := os.WriteFile(filePath, []byte("new"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			objectKey, hash, _, err := uploadGeneration(ctx, st, logger, "a.example.com.crt", filePath, sha256Hex(tc.hashed), int64(len(tc.hashed)), key)
+			if err != nil {
+				t.Fatalf("uploadGeneration failed: %v", err)
+			}
+			if hash != sha256Hex("new") || !strings.Contains(objectKey, hash) {
+				t.Errorf("Unexpected object %s with hash %s", objectKey, hash)
+			}
+
+			// Only the object of the current content is left
+			objects, err := st.List(ctx)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(objects) != 1 || objects[0].Key != objectKey {
+				t.Errorf("Unexpected objects %+v", objects)
+			}
+
+			data, err := storage.Download(ctx, st, objectKey)
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			plain, err := crypto.DecryptData(data, key)
+			if err != nil || string(plain) != "new" {
+				t.Errorf("Unexpected object content %q, %v", plain, err)
+			}
+		})
+	}
+}
+
+// testPusher publishes the certificate files in its own cert_dir
+type testPusher struct {
+	t        *testing.T
+	cfg      *config.PushConfig
+	provider keyprovider.KeyProvider
+}
+
+func newTestPusher(t *testing.T, id, keyDir string) *testPusher {
+	return &testPusher{
+		t:        t,
+		cfg:      &config.PushConfig{CertDir: t.TempDir(), KeyDir: keyDir, PusherID: id},
+		provider: keyprovider.NewLocal(keyDir, nil),
+	}
+}
+
+// write replaces the certificate files in cert_dir
+func (p *testPusher) write(files map[string]string) map[string][]string {
+	entries, _ := os.ReadDir(p.cfg.CertDir)
+	for _, e := range entries {
+		os.Remove(filepath.Join(p.cfg.CertDir, e.Name()))
+	}
+
+	certFiles := make(map[string][]string)
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(p.cfg.CertDir, name), []byte(data), 0644); err != nil {
+			p.t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		certName, _ := config.ExtractCertName(name)
+		certFiles[certName] = append(certFiles[certName], name)
+	}
+	return certFiles
+}
+
+// publish publishes files to st and returns the files uploaded
+func (p *testPusher) publish(st storage.Storage, files map[string]string) []string {
+	uploaded, _, err := publishCertificates(context.Background(), p.cfg, st, p.provider, slog.New(slog.DiscardHandler), p.write(files))
+	if err != nil {
+		p.t.Fatalf("publishCertificates by %q failed: %v", p.cfg.PusherID, err)
+	}
+	return uploaded
+}
+
+// loadManifest returns the manifest published to st
+func loadManifest(t *testing.T, st storage.Storage) *manifest.Manifest {
+	m, _, err := storage.LoadManifest(context.Background(), st, "")
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	return m
+}
+
+// checkEntry checks the owner and content hash of a manifest entry
+func checkEntry(t *testing.T, m *manifest.Manifest, fileName, owner, data string) {
+	t.Helper()
+	e, ok := m.Files[fileName]
+	if !ok {
+		t.Errorf("%s is not published", fileName)
+		return
+	}
+	if e.Owner != owner || e.SHA256 != sha256Hex(data) {
+		t.Errorf("%s: expected owner %q and content %q, got %+v", fileName, owner, data, e)
+	}
+}
+
+func TestPublishCertificatesOwnership(t *testing.T) {
+	st := storage.NewFilesystem("test", t.TempDir())
+	keyDir := t.TempDir()
+
+	// A pusher without ID leaves its entries unowned
+	legacy := newTestPusher(t, "", keyDir)
+	legacy.publish(st, map[string]string{"shared.example.com.crt": "legacy"})
+	checkEntry(t, loadManifest(t, st), "shared.example.com.crt", "", "legacy")
+
+	// Unowned entries are claimed
+	a := newTestPusher(t, "a", keyDir)
+	uploaded := a.publish(st, map[string]string{
+		"a.example.com.crt":      "a1",
+		"shared.example.com.crt": "a1",
+	})
+	if !slices.Equal(uploaded, []string{"a.example.com.crt", "shared.example.com.crt"}) {
+		t.Errorf("Unexpected uploads %v", uploaded)
+	}
+	m := loadManifest(t, st)
+	checkEntry(t, m, "a.example.com.crt", "a", "a1")
+	checkEntry(t, m, "shared.example.com.crt", "a", "a1")
+
+	// Entries owned by another pusher are skipped
+	b := newTestPusher(t, "b", keyDir)
+	uploaded = b.publish(st, map[string]string{
+		"a.example.com.crt":      "b1",
+		"shared.example.com.crt": "b1",
+		"b.example.com.crt":      "b1",
+	})
+	if !slices.Equal(uploaded, []string{"b.example.com.crt"}) {
+		t.Errorf("Unexpected uploads %v", uploaded)
+	}
+	m = loadManifest(t, st)
+	checkEntry(t, m, "a.example.com.crt", "a", "a1")
+	checkEntry(t, m, "shared.example.com.crt", "a", "a1")
+	checkEntry(t, m, "b.example.com.crt", "b", "b1")
+
+	// Removing files only removes the pusher's own entries
+	uploaded = a.publish(st, map[string]string{"a.example.com.crt": "a2"})
+	if !slices.Equal(uploaded, []string{"a.example.com.crt"}) {
+		t.Errorf("Unexpected uploads %v", uploaded)
+	}
+	m = loadManifest(t, st)
+	checkEntry(t, m, "a.example.com.crt", "a", "a2")
+	checkEntry(t, m, "b.example.com.crt", "b", "b1")
+	if _, ok := m.Files["shared.example.com.crt"]; ok || len(m.Files) != 2 {
+		t.Errorf("Unexpected manifest %+v", m.Files)
+	}
+
+	// Nothing changed, nothing is published
+	if uploaded, didPublish, err := publishCertificates(context.Background(), b.cfg, st, b.provider, slog.New(slog.DiscardHandler), b.write(map[string]string{"b.example.com.crt": "b1"})); err != nil || didPublish || len(uploaded) != 0 {
+		t.Errorf("Unchanged files were published: %v, %v, %v", uploaded, didPublish, err)
+	}
+}
+
+func TestPublishCertificatesEmptyCertDir(t *testing.T) {
+	st := storage.NewFilesystem("test", t.TempDir())
+	keyDir := t.TempDir()
+	a := newTestPusher(t, "a", keyDir)
+	a.publish(st, map[string]string{"a.example.com.crt": "a1"})
+
+	// An empty cert_dir, e.g. an unmounted volume, doesn't unpublish the
+	// pusher's certificates
+	_, didPublish, err := publishCertificates(context.Background(), a.cfg, st, a.provider, slog.New(slog.DiscardHandler), a.write(nil))
+	if err == nil || didPublish {
+		t.Errorf("Empty cert_dir was published: %v, %v", didPublish, err)
+	}
+	checkEntry(t, loadManifest(t, st), "a.example.com.crt", "a", "a1")
+
+	// Pushers without published certificates are not affected
+	b := newTestPusher(t, "b", keyDir)
+	b.publish(st, nil)
+	checkEntry(t, loadManifest(t, st), "a.example.com.crt", "a", "a1")
+}
+
+// racingStorage lets another pusher publish right before the first
+// manifest update, so the update conflicts
+type racingStorage struct {
+	storage.Storage
+	race      func()
+	conflicts int
+	puts      map[string]int
+}
+
+func (r *racingStorage) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	if fileName, ok := manifest.ObjectFileName(key); ok && !strings.HasSuffix(key, ".dek") {
+		r.puts[fileName]++
+	}
+	return r.Storage.Put(ctx, key, body, size)
+}
+
+func (r *racingStorage) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error) {
+	if r.race != nil {
+		r.race()
+		r.race = nil
+	}
+	newETag, err := r.Storage.PutIfMatch(ctx, key, data, etag)
+	if errors.Is(err, storage.ErrConflict) {
+		r.conflicts++
+	}
+	return newETag, err
+}
+
+func TestPublishCertificatesConflict(t *testing.T) {
+	fsStorage := storage.NewFilesystem("test", t.TempDir())
+	keyDir := t.TempDir()
+	a := newTestPusher(t, "a", keyDir)
+	b := newTestPusher(t, "b", keyDir)
+
+	st := &racingStorage{
+		Storage: fsStorage,
+		race:    func() { b.publish(fsStorage, map[string]string{"b.example.com.crt": "b1"}) },
+		puts:    make(map[string]int),
+	}
+
+	uploaded := a.publish(st, map[string]string{
+		"a.example.com.crt": "a1",
+		"a.example.com.key": "a1-key",
+	})
+	if st.conflicts != 1 {
+		t.Errorf("Expected one conflict, got %d", st.conflicts)
+	}
+	if !slices.Equal(uploaded, []string{"a.example.com.crt", "a.example.com.key"}) {
+		t.Errorf("Unexpected uploads %v", uploaded)
+	}
+
+	// The retry reuses the objects staged by the first attempt
+	if st.puts["a.example.com.crt"] != 1 || st.puts["a.example.com.key"] != 1 {
+		t.Errorf("Objects were uploaded again: %v", st.puts)
+	}
+
+	// Both pushers' changes are published
+	m := loadManifest(t, fsStorage)
+	checkEntry(t, m, "a.example.com.crt", "a", "a1")
+	checkEntry(t, m, "a.example.com.key", "a", "a1-key")
+	checkEntry(t, m, "b.example.com.crt", "b", "b1")
+
+	objects, err := fsStorage.List(context.Background())
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	refs := m.Referenced()
+	for _, obj := range objects {
+		if obj.Key != manifest.FileName && !refs[obj.Key] {
+			t.Errorf("Unreferenced object %s", obj.Key)
+		}
+	}
+}
+
+func TestNotifyPullersReportsPublishedStorages(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies <- string(data)
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_NOTIFY_SECRET", "secret")
+	cfg := &config.PushConfig{
+		Notify: []config.NotifyConfig{{URL: server.URL, Secret: config.PassphraseConfig{Env: "TEST_NOTIFY_SECRET"}}},
+	}
+
+	// Only destinations are configured, so the [s3] table is empty
+	published := []config.StorageConfig{
+		{Name: "backup", S3: config.S3Config{Bucket: "backup", Prefix: "certs"}},
+		{Name: "mirror", Path: "/mnt/certificates"},
+	}
+	notifyPullers(context.Background(), cfg, slog.New(slog.DiscardHandler), published, []string{"a.example.com.crt"})
+
+	want := `{"storages":[{"name":"backup","bucket":"backup","prefix":"certs"},{"name":"mirror","path":"/mnt/certificates"}],"files":["a.example.com.crt"]}`
+	if body := <-bodies; body != want {
+		t.Errorf("Unexpected notification %s", body)
+	}
+}
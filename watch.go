@@ -0,0 +1,91 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/digilolnet/digilol-cert-pushpuller/internal/config"
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultWatchDebounce is how long certificate files must stay unchanged
+// before a watch triggered upload
+const defaultWatchDebounce = 5 * time.Second
+
+// watchCertDir watches dir for changes to certificate files until ctx is
+// cancelled. The returned channel receives a value once changes have
+// settled for debounce; bursts of writes, e.g. lego writing a certificate
+// and its key, result in a single value.
+func watchCertDir(ctx context.Context, logger *slog.Logger, dir string, debounce time.Duration) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %w", err)
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watch %s: %w", dir, err)
+	}
+
+	settled := make(chan struct{}, 1)
+
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// Ignore temporary files, anything that isn't a
+				// certificate and permission changes
+				if _, isCert := config.ExtractCertName(filepath.Base(event.Name)); !isCert || event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				logger.Debug("certificate file changed", "path", event.Name, "op", event.Op.String())
+				timer.Reset(debounce)
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("watching certificate directory failed", "dir", dir, "error", err)
+
+			case <-timer.C:
+				select {
+				case settled <- struct{}{}:
+				default:
+					// An upload is already pending
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return settled, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2025 Laurynas Četyrkinas <laurynas@digilol.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchCertDirDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	debounce := 200 * time.Millisecond
+	settled, err := watchCertDir(ctx, slog.New(slog.DiscardHandler), dir, debounce)
+	if err != nil {
+		t.Fatalf("watchCertDir failed: %v", err)
+	}
+
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	// Files that aren't certificates are ignored
+	write("notes.txt")
+	write(".a.example.com.crt.tmp-123")
+	select {
+	case <-settled:
+		t.Fatal("Changes to other files were reported")
+	case <-time.After(2 * debounce):
+	}
+
+	// A burst of writes is reported once after it settled
+	start := time.Now()
+	for range 5 {
+		write("a.example.com.crt")
+		write("a.example.com.key")
+		time.Sleep(debounce / 4)
+	}
+	burst := time.Since(start)
+
+	select {
+	case <-settled:
+		if elapsed := time.Since(start); elapsed < burst+debounce/2 {
+			t.Errorf("Reported before the files settled, after %s", elapsed)
+		}
+	case <-time.After(burst + 5*debounce):
+		t.Fatal("Changes were not reported")
+	}
+
+	select {
+	case <-settled:
+		t.Error("Burst was reported more than once")
+	case <-time.After(2 * debounce):
+	}
+
+	// Changes while a report is pending are coalesced into it
+	write("b.example.com.crt")
+	time.Sleep(2 * debounce)
+	write("b.example.com.key")
+	time.Sleep(2 * debounce)
+	<-settled
+	select {
+	case <-settled:
+		t.Error("Pending report was duplicated")
+	default:
+	}
+}